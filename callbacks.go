@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	"gopkg.in/telebot.v3"
+)
+
+// Inline keyboards are routed by button unique, parameters are kept in callback data.
+// Parameters that don't fit into 64 bytes are saved as models.CallbackState, buttons carry its token.
+// So keyboards keep working after restart and no handlers are registered per sent keyboard.
+var (
+	btnRepliesTopic  = &telebot.Btn{Unique: "replies_topic"}
+	btnRepliesPage   = &telebot.Btn{Unique: "replies_page"}
+	btnThread        = &telebot.Btn{Unique: "thread"}
+	btnNotifications = &telebot.Btn{Unique: "notif"}
+)
+
+func (b *Bot) initCallbackHandlers(viewers, editors *telebot.Group) {
+	viewers.Handle(btnRepliesTopic, b.handleRepliesTopicButton)
+	viewers.Handle(btnRepliesPage, b.handleRepliesPageButton)
+	viewers.Handle(btnThread, b.handleThreadButton)
+	editors.Handle(btnNotifications, b.handleNotificationsButton)
+	// buttons without a handler, e.g. of keyboards sent by older versions of the bot
+	b.client.Handle(telebot.OnCallback, b.handleExpiredCallback)
+}
+
+func (b *Bot) handleExpiredCallback(ctx telebot.Context) error {
+	return ctx.Respond(&telebot.CallbackResponse{Text: "Эта кнопка устарела, повторите команду", ShowAlert: true})
+}
+
+// saveCallbackState saves keyboard parameters, new token is generated if token is empty.
+func (b *Bot) saveCallbackState(token string, chatId int64, state interface{}) (string, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		token, err = newToken()
+		if err != nil {
+			return "", err
+		}
+	}
+	err = b.db.SaveCallbackState(models.CallbackState{
+		Token:     token,
+		ChatId:    chatId,
+		Data:      string(data),
+		UpdatedAt: time.Now(),
+	})
+	return token, err
+}
+
+// loadCallbackState decodes keyboard parameters into state. If ok is false, user is already notified.
+func (b *Bot) loadCallbackState(ctx telebot.Context, token string, state interface{}) (bool, error) {
+	callbackState, err := b.db.GetCallbackState(token)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && callbackState.ChatId != ctx.Chat().ID) {
+		return false, b.handleExpiredCallback(ctx)
+	}
+	if err != nil {
+		return false, err
+	}
+	err = json.Unmarshal([]byte(callbackState.Data), state)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isNotModified reports whether edit failed only because the message already has the same content.
+func isNotModified(err error) bool {
+	return errors.Is(err, telebot.ErrMessageNotModified) || errors.Is(err, telebot.ErrSameMessageContent)
+}
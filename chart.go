@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	chartWidth        = 900
+	chartHeight       = 400
+	chartMarginLeft   = 50
+	chartMarginRight  = 20
+	chartMarginTop    = 20
+	chartMarginBottom = 30
+	chartGridLines    = 4
+)
+
+var (
+	chartBackground = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	chartGrid       = color.RGBA{R: 0xe0, G: 0xe0, B: 0xe0, A: 0xff}
+	chartAxis       = color.RGBA{R: 0x60, G: 0x60, B: 0x60, A: 0xff}
+	chartSent       = color.RGBA{R: 0x3b, G: 0x82, B: 0xf6, A: 0xff}
+	chartReceived   = color.RGBA{R: 0xf5, G: 0x9e, B: 0x0b, A: 0xff}
+)
+
+// chartDay is one bar group of the activity chart.
+type chartDay struct {
+	Day      time.Time
+	Sent     int
+	Received int
+}
+
+// renderActivityChart draws sent and received messages by day as grouped bars and encodes it as PNG.
+// basicfont has only ASCII glyphs, so labels are numbers and dates, the legend goes into the photo caption.
+func renderActivityChart(days []chartDay) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: chartBackground}, image.Point{}, draw.Src)
+
+	plot := image.Rect(chartMarginLeft, chartMarginTop, chartWidth-chartMarginRight, chartHeight-chartMarginBottom)
+	maxValue := 0
+	for _, day := range days {
+		if day.Sent > maxValue {
+			maxValue = day.Sent
+		}
+		if day.Received > maxValue {
+			maxValue = day.Received
+		}
+	}
+	// round the scale up so that every grid line is an integer
+	if rest := maxValue % chartGridLines; rest != 0 || maxValue == 0 {
+		maxValue += chartGridLines - rest
+	}
+
+	for i := 0; i <= chartGridLines; i++ {
+		y := plot.Max.Y - plot.Dy()*i/chartGridLines
+		fillRect(img, image.Rect(plot.Min.X, y, plot.Max.X, y+1), chartGrid)
+		label := strconv.Itoa(maxValue * i / chartGridLines)
+		drawText(img, label, plot.Min.X-6-textWidth(label), y+4)
+	}
+
+	if len(days) > 0 {
+		slot := float64(plot.Dx()) / float64(len(days))
+		barWidth := int(slot * 0.4)
+		if barWidth < 1 {
+			barWidth = 1
+		}
+		barHeight := func(value int) int {
+			return plot.Dy() * value / maxValue
+		}
+		// at most ~8 date labels fit under the plot
+		labelEvery := (len(days) + 7) / 8
+		for i, day := range days {
+			x := plot.Min.X + int(slot*float64(i)+slot*0.1)
+			fillRect(img, image.Rect(x, plot.Max.Y-barHeight(day.Sent), x+barWidth, plot.Max.Y), chartSent)
+			fillRect(img, image.Rect(x+barWidth, plot.Max.Y-barHeight(day.Received), x+2*barWidth, plot.Max.Y), chartReceived)
+			if i%labelEvery == 0 {
+				label := day.Day.Format("01-02")
+				center := plot.Min.X + int(slot*float64(i)+slot/2)
+				drawText(img, label, center-textWidth(label)/2, plot.Max.Y+18)
+			}
+		}
+	}
+
+	fillRect(img, image.Rect(plot.Min.X, plot.Min.Y, plot.Min.X+1, plot.Max.Y+1), chartAxis)
+	fillRect(img, image.Rect(plot.Min.X, plot.Max.Y, plot.Max.X, plot.Max.Y+1), chartAxis)
+
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, img)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func fillRect(img draw.Image, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, &image.Uniform{C: c}, image.Point{}, draw.Src)
+}
+
+func drawText(img draw.Image, text string, x, y int) {
+	drawer := &font.Drawer{
+		Dst:  img,
+		Src:  &image.Uniform{C: chartAxis},
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	drawer.DrawString(text)
+}
+
+func textWidth(text string) int {
+	return font.MeasureString(basicfont.Face7x13, text).Round()
+}
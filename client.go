@@ -1,16 +1,15 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/binary"
+	"database/sql"
+	"errors"
 	"fmt"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
-	"github.com/cespare/xxhash/v2"
 	"github.com/pymq/tfahack/db"
 	"github.com/pymq/tfahack/models"
 	log "github.com/sirupsen/logrus"
@@ -21,44 +20,81 @@ import (
 
 type Bot struct {
 	client *telebot.Bot
-	poller *telebot.LongPoller
+	poller *telebot.LongPoller // nil in webhook mode
 	db     *db.DB
 	cfg    Config
 
-	// tgMessageId -> real message from db
-	showRepliesPagingState     map[int]models.Message
-	showRepliesPagingStateLock sync.Mutex
+	stopCh         chan struct{}
+	deliveryWakeCh chan struct{}
+	wg             sync.WaitGroup
+	// running update handlers, see runHandlers
+	handlersWg sync.WaitGroup
+
+	// tgUserId -> last synced name and username, to skip db lookups on every update
+	knownProfiles     map[int64]string
+	knownProfilesLock sync.Mutex
 }
 
 func NewBot(cfg Config, db *db.DB) (*Bot, error) {
-	poller := &telebot.LongPoller{Timeout: 10 * time.Second}
+	longPoller := &telebot.LongPoller{Timeout: cfg.PollTimeout.Duration}
+	var poller telebot.Poller = longPoller
+	var webhookPoller *WebhookPoller
+	if cfg.WebhookListen != "" {
+		webhookPoller = NewWebhookPoller(cfg)
+		poller = webhookPoller
+		longPoller = nil
+	}
 	b, err := telebot.NewBot(telebot.Settings{
 		OnError: func(err error, ctx telebot.Context) {
 			log.Errorf("telegram bot: %s", err)
 		},
 		Token:  cfg.APIToken,
 		Poller: poller,
+		// handlers are started by runHandlers, so that Close can wait for them
+		Synchronous: true,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("create client: %v", err)
 	}
 
 	bot := &Bot{
-		client:                 b,
-		poller:                 poller,
-		cfg:                    cfg,
-		db:                     db,
-		showRepliesPagingState: make(map[int]models.Message),
-	}
+		client:         b,
+		poller:         longPoller,
+		cfg:            cfg,
+		db:             db,
+		knownProfiles:  make(map[int64]string),
+		stopCh:         make(chan struct{}),
+		deliveryWakeCh: make(chan struct{}, 1),
+	}
+	b.Use(bot.runHandlers)
 	if cfg.LogAllEvents {
 		b.Use(middleware.Logger())
 	}
+	b.Use(bot.SyncRecipientProfile)
 	err = bot.initHandlers()
 	if err != nil {
 		return nil, fmt.Errorf("init handlers: %v", err)
 	}
+	if longPoller != nil {
+		err = bot.prepareLongPolling()
+		if err != nil {
+			return nil, fmt.Errorf("prepare long polling: %v", err)
+		}
+	} else {
+		err = webhookPoller.Prepare(b)
+		if err != nil {
+			return nil, fmt.Errorf("prepare webhook: %v", err)
+		}
+	}
 	go b.Start()
 
+	bot.wg.Add(5)
+	go bot.runDigests()
+	go bot.runWizardTimeouts()
+	go bot.runScheduler()
+	go bot.runDeliveries()
+	go bot.runStateCleanup()
+
 	return bot, nil
 }
 
@@ -91,39 +127,201 @@ func (b *Bot) SendLongMessageInParts(to telebot.Recipient, message string, silen
 
 func (b *Bot) Close() {
 	b.client.Stop()
-	// TODO: save b.poller.LastUpdateID and set on restart ?
+	if b.poller != nil {
+		err := b.savePollerOffset()
+		if err != nil {
+			log.Errorf("save poller offset: %v", err)
+		}
+	} else {
+		// telegram got 200 for these updates and won't send them again
+		for n := len(b.client.Updates); n > 0; n-- {
+			b.client.ProcessUpdate(<-b.client.Updates)
+		}
+	}
+	// handlers use the db, which is closed right after Close
+	b.handlersWg.Wait()
+	// unfinished deliveries stay pending and are resumed on next start
+	close(b.stopCh)
+	b.wg.Wait()
 }
 
 func (b *Bot) initHandlers() error {
-	adminsOnly := b.client.Group()
-	adminsOnly.Use(IgnoreNonPrivateMessages)
-	if len(b.cfg.AdminIDs) > 0 {
-		// TODO: reply to user that he can't use this command
-		adminsOnly.Use(middleware.Whitelist(b.cfg.AdminIDs...))
-	}
+	// sender commands are available to organization members according to their role
+	viewers := b.client.Group()
+	viewers.Use(IgnoreNonPrivateMessages, b.RequireRole(models.OrgRoleViewer))
+	editors := b.client.Group()
+	editors.Use(IgnoreNonPrivateMessages, b.RequireRole(models.OrgRoleEditor))
+	owners := b.client.Group()
+	owners.Use(IgnoreNonPrivateMessages, b.RequireRole(models.OrgRoleOwner))
 
 	b.client.Handle("/start", b.handleStart, IgnoreNonPrivateMessages)
-	adminsOnly.Handle("/create_mailing_list", b.handleCreateMailingList)
-	adminsOnly.Handle("/send_messages", b.handleSendMessages)
-	adminsOnly.Handle("/show_replies", b.handleShowReplies)
-	adminsOnly.Handle("/show_replies_old", b.handleShowRepliesOld)
-	adminsOnly.Handle("/notifications_config", b.handleNotificationsConfig)
-	adminsOnly.Handle("/topics_stats", b.handleTopicsStats)
-	// rest text messages
-	b.client.Handle(telebot.OnText, b.handleAllTextMessages)
+	b.initUnsubscribeHandlers()
+	b.initEngagementHandlers()
+	editors.Handle("/create_mailing_list", b.handleCreateMailingList)
+	editors.Handle("/send_messages", b.handleSendMessages)
+	viewers.Handle("/show_replies", b.handleShowReplies)
+	viewers.Handle("/show_replies_old", b.handleShowRepliesOld)
+	viewers.Handle("/search", b.handleSearch)
+	viewers.Handle("/export", b.handleExport)
+	editors.Handle("/notifications_config", b.handleNotificationsConfig)
+	viewers.Handle("/topics_stats", b.handleTopicsStats)
+	viewers.Handle("/inactive", b.handleInactiveRecipients)
+	editors.Handle("/schedule", b.handleSchedule)
+	viewers.Handle("/jobs", b.handleJobs)
+	editors.Handle("/job_edit", b.handleJobEdit)
+	editors.Handle("/job_cancel", b.handleJobCancel)
+	b.initWizardHandlers(editors)
+	b.initListsHandlers(viewers, editors)
+	b.initOrgHandlers(viewers, owners)
+	b.initPollHandlers(viewers, editors)
+	b.initTemplateHandlers(viewers, editors)
+	b.initCallbackHandlers(viewers, editors)
+	// rest text and media messages
+	b.client.Handle(telebot.OnText, b.handleAllMessages)
+	for _, endpoint := range mediaEndpoints {
+		b.client.Handle(endpoint, b.handleAllMessages)
+	}
 
 	err := b.client.SetCommands([]telebot.Command{
 		{
 			Text:        "start",
 			Description: "подписаться на рассылки",
 		},
+		{
+			Text:        "stop",
+			Description: "отписаться от всех рассылок",
+		},
+		{
+			Text:        "org_create",
+			Description: "создать организацию. формат: /org_create <name>",
+		},
+		{
+			Text:        "org",
+			Description: "ваша организация и ее участники",
+		},
+		{
+			Text:        "org_invite",
+			Description: "пригласить коллегу. формат: /org_invite [editor|viewer|owner]",
+		},
+		{
+			Text:        "org_role",
+			Description: "изменить роль участника. формат: /org_role <member> <editor|viewer|owner>",
+		},
+		{
+			Text:        "org_remove",
+			Description: "удалить участника. формат: /org_remove <member>",
+		},
+		{
+			Text:        "org_leave",
+			Description: "покинуть организацию, последний участник удаляет ее",
+		},
 		{
 			Text:        "create_mailing_list",
 			Description: "создать список для рассылки. формат: /create_mailing_list <mailing_list_name> <recipient1> <recipient2> <...>",
 		},
+		{
+			Text:        "lists",
+			Description: "ваши списки рассылки",
+		},
+		{
+			Text:        "list_show",
+			Description: "участники списка. формат: /list_show <mailing_list>",
+		},
+		{
+			Text:        "list_add",
+			Description: "добавить участников. формат: /list_add <mailing_list> <recipient1> <...>",
+		},
+		{
+			Text:        "list_remove",
+			Description: "удалить участников. формат: /list_remove <mailing_list> <recipient1> <...>",
+		},
+		{
+			Text:        "list_rename",
+			Description: "переименовать список. формат: /list_rename <mailing_list> <new_name>",
+		},
+		{
+			Text:        "list_delete",
+			Description: "удалить список. формат: /list_delete <mailing_list>",
+		},
+		{
+			Text:        "list_invite",
+			Description: "ссылка-приглашение в список. формат: /list_invite <mailing_list> [канал] [expires=<+72h|2006-01-02T15:04>] [limit=<n>]",
+		},
+		{
+			Text:        "invites",
+			Description: "ваши ссылки-приглашения и сколько подписчиков они привели",
+		},
+		{
+			Text:        "invite_show",
+			Description: "подписчики, пришедшие по ссылке. формат: /invite_show <token>",
+		},
+		{
+			Text:        "invite_revoke",
+			Description: "отключить ссылку-приглашение. формат: /invite_revoke <token>",
+		},
+		{
+			Text:        "import_list",
+			Description: "создать или дополнить список из csv/json файла. формат: /import_list <mailing_list> [replace] ответом на файл",
+		},
+		{
+			Text:        "export_list",
+			Description: "выгрузить список в файл. формат: /export_list <mailing_list> [csv|json]",
+		},
 		{
 			Text:        "send_messages",
-			Description: "отправить рассылку по указанному топику и списку рассылки. формат: /send_messages <topic> <mailing_list_name>",
+			Description: "отправить рассылку по указанному топику и списку рассылки. формат: /send_messages [-tmpl] <topic> <mailing_list> <message>, для медиа - ответом на сообщение. -tmpl подставляет переменные. без кнопок реакций, они есть в /broadcast",
+		},
+		{
+			Text:        "send_poll",
+			Description: "отправить опрос или викторину. формат: /send_poll <topic> <mailing_list> [quiz=<n>|multi], далее с новой строки вопрос и варианты",
+		},
+		{
+			Text:        "poll_results",
+			Description: "результаты опросов по топику. формат: /poll_results <topic>",
+		},
+		{
+			Text:        "poll_export",
+			Description: "выгрузить ответы на опросы в csv. формат: /poll_export <topic>",
+		},
+		{
+			Text:        "template_save",
+			Description: "сохранить шаблон сообщения с {{.RecipientName}}, {{.TGName}} и полями списка. формат: /template_save <name> <text>",
+		},
+		{
+			Text:        "templates",
+			Description: "ваши шаблоны сообщений",
+		},
+		{
+			Text:        "template_delete",
+			Description: "удалить шаблон. формат: /template_delete <name>",
+		},
+		{
+			Text:        "send_template",
+			Description: "отправить рассылку по шаблону без кнопок реакций. формат: /send_template <topic> <mailing_list> <template>",
+		},
+		{
+			Text:        "broadcast",
+			Description: "пошагово составить и отправить рассылку, в том числе с кнопками реакций и переменными",
+		},
+		{
+			Text:        "cancel",
+			Description: "отменить составление рассылки",
+		},
+		{
+			Text:        "schedule",
+			Description: "запланировать рассылку без кнопок реакций. формат: /schedule [-tmpl] <2006-01-02T15:04|+2h> <once|daily|weekly|36h> <topic> <mailing_list> <message>",
+		},
+		{
+			Text:        "jobs",
+			Description: "список запланированных рассылок",
+		},
+		{
+			Text:        "job_edit",
+			Description: "перенести запланированную рассылку. формат: /job_edit <id> <время> [повтор]",
+		},
+		{
+			Text:        "job_cancel",
+			Description: "отменить запланированную рассылку. формат: /job_cancel <id>",
 		},
 		{
 			Text:        "show_replies",
@@ -131,83 +329,116 @@ func (b *Bot) initHandlers() error {
 		},
 		{
 			Text:        "show_replies_old",
-			Description: "old! вывести ответы по топику. /show_replies <topic> [search_query_word]",
+			Description: "old! вывести ответы по топику. /show_replies_old <topic> [search query]",
+		},
+		{
+			Text:        "search",
+			Description: "поиск по ответам во всех топиках. формат: /search <words>",
+		},
+		{
+			Text:        "export",
+			Description: "выгрузить переписку по топику в файл. формат: /export <topic> [csv|jsonl|xlsx]",
 		},
 		{
 			Text:        "notifications_config",
-			Description: "настройка уведомлений",
+			Description: "настройка уведомлений. /notifications_config [quiet <from_hour> <to_hour> | quiet off]",
+		},
+		{
+			Text:        "inactive",
+			Description: "получатели из ваших списков, заблокировавшие бота",
 		},
 		{
 			Text:        "topics_stats",
-			Description: "вывод статистики сообщений по топикам",
+			Description: "статистика по топикам и спискам. формат: /topics_stats [<2006-01-02|30d> [<2006-01-02>]] [chart]",
 		},
 	})
 
 	return err
 }
 
+// command: /start [invite_token]
+// token is either a mailing list invite or a teammate invite to organization
 func (b *Bot) handleStart(ctx telebot.Context) error {
+	token := ctx.Message().Payload
+	if token != "" {
+		invite, err := b.db.GetOrgInviteByToken(token)
+		if err == nil {
+			return b.joinOrganization(ctx, invite)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
 	recipients, err := b.db.GetRecipientsByIds([]int64{ctx.Chat().ID})
 	if err != nil {
 		log.Errorf("stat command: recipients select: %v", err)
 		return err
 	}
-	if len(recipients) > 0 {
-		return ctx.Send("Вы уже в списке, как только для вас будет сообщение мы вам напишем!")
+
+	var recipient models.Recipient
+	var greeting string
+	newRecipient := len(recipients) == 0
+	if !newRecipient {
+		recipient = recipients[0]
+		greeting = "Вы уже в списке, как только для вас будет сообщение мы вам напишем!"
+		if recipient.Inactive || recipient.Unsubscribed {
+			err = b.db.SetRecipientActive(recipient.RecipientId)
+			if err != nil {
+				log.Errorf("start command: reactivate recipient: %v", err)
+				return err
+			}
+			err = b.db.SetRecipientUnsubscribed(recipient.RecipientId, false)
+			if err != nil {
+				log.Errorf("start command: resubscribe recipient: %v", err)
+				return err
+			}
+			greeting = "С возвращением! Вы снова будете получать рассылки от партнеров"
+		}
+	} else {
+		recipient, err = b.db.AddRecipient(models.Recipient{
+			RecipientName:   userFullName(ctx.Sender()),
+			RecipientTGId:   ctx.Chat().ID,
+			RecipientTGName: ctx.Sender().Username,
+		})
+		if err != nil {
+			log.Errorf("start command: recipient insert: %v", err)
+			return err
+		}
+		greeting = "Рады видеть вас в нашем боте! Теперь вы сможете получать рассылки от партнеров!"
 	}
-	err = b.db.AddRecipient(models.Recipient{
-		RecipientName:   fmt.Sprintf("%s %s", ctx.Chat().FirstName, ctx.Chat().LastName),
-		RecipientTGId:   ctx.Chat().ID,
-		RecipientTGName: ctx.Chat().Username,
-	})
-	if err != nil {
-		log.Errorf("start command: recipient insert: %v", err)
-		return err
+
+	if token != "" {
+		return b.joinByInvite(ctx, recipient, newRecipient, token, greeting)
 	}
-	return ctx.Send("Рады видеть вас в нашем боте! Теперь вы сможете получать рассылки от партнеров!")
+	return ctx.Send(greeting)
 }
 
 // command: /create_mailing_list <mailing_list_name> <recipient1> <recipient2> <...>
 func (b *Bot) handleCreateMailingList(ctx telebot.Context) error {
 	args := ctx.Args()
-	if len(args) < 2 {
-		return ctx.Send("Пожалуйста, введите данные в формате /create_mailing_list <Название_списка> <Получатель1> <Получатель2> <...>")
-	}
-	recipients := args[1:]
-
-	uniqueRecipients := make(map[string]struct{})
-	errors := make([]string, 0)
-	n := 0
-	for _, recipient := range args[1:] {
-		recipient = strings.TrimPrefix(recipient, "@")
-		if _, ok := uniqueRecipients[recipient]; ok {
-			continue
-		}
-		uniqueRecipients[recipient] = struct{}{}
-		recipients[n] = recipient
-		n++
+	if len(args) < 1 || (len(args) < 2 && !hasReplyRecipient(ctx.Message())) {
+		return ctx.Send("Пожалуйста, введите данные в формате /create_mailing_list <Название_списка> <Получатель1> <Получатель2> <...>\n" +
+			"Получатель - @username или числовой Telegram ID. Также можно ответить командой на пересланное сообщение пользователя или его контакт")
 	}
-	recipients = recipients[:n]
-	recipientsInfo, err := b.db.GetRecipientsByTGNames(recipients)
+	existing, err := b.db.GetMailingListsByName(senderOrgId(ctx), args[0])
 	if err != nil {
-		log.Errorf("create mailing list: load recipients: %v", err)
 		return err
 	}
-
-	recipientsIds := make([]int64, len(recipientsInfo))
-	for id, recipient := range recipientsInfo {
-		recipientsIds[id] = recipient.RecipientId
-		delete(uniqueRecipients, recipient.RecipientTGName)
+	if len(existing) > 0 {
+		return ctx.Send(fmt.Sprintf("Список '%s' уже существует. Добавить участников: /list_add %s <Получатель1> <...>", args[0], args[0]))
 	}
 
-	for recipient := range uniqueRecipients {
-		errors = append(errors, fmt.Sprintf("@%s - Пользователь не подключен к боту", recipient))
+	recipientsIds, errors, err := b.commandRecipients(ctx, args[1:])
+	if err != nil {
+		log.Errorf("create mailing list: load recipients: %v", err)
+		return err
 	}
 
 	if len(recipientsIds) == 0 {
 		return ctx.Send(fmt.Sprintf("Не удалось создать список\n%s", strings.Join(errors, ",\n")))
 	}
-	err = b.db.AddMailingList(models.MailingList{ListName: args[0], SenderTGId: ctx.Chat().ID}, recipientsIds)
+	err = b.db.AddMailingList(models.MailingList{ListName: args[0], SenderTGId: senderOrgId(ctx)}, recipientsIds)
 	if err != nil {
 		log.Errorf("create mailing list: %v", err)
 		return err
@@ -220,7 +451,7 @@ func (b *Bot) handleCreateMailingList(ctx telebot.Context) error {
 }
 
 func (b *Bot) handleShowReplies(ctx telebot.Context) error {
-	topics, err := b.db.GetUserTopicsBySender(ctx.Chat().ID)
+	topics, err := b.db.GetUserTopicsBySender(senderOrgId(ctx))
 	if err != nil {
 		return err
 	}
@@ -228,296 +459,276 @@ func (b *Bot) handleShowReplies(ctx telebot.Context) error {
 	var replyMarkup = &telebot.ReplyMarkup{}
 	var buttons []telebot.Btn
 	for _, topic := range topics {
-		h := xxhash.New()
-		_ = binary.Write(h, binary.BigEndian, ctx.Chat().ID)
-		sumBytes := h.Sum([]byte(topic.Topic))
-		uniquePrefix := base64.URLEncoding.EncodeToString(sumBytes)
-		uniquePrefix = strings.TrimRight(uniquePrefix, "=")
-
 		data := strconv.FormatInt(topic.TopicId, 10)
-		var btn = replyMarkup.Data(topic.Topic, uniquePrefix+"_show", data)
-		buttons = append(buttons, btn)
+		buttons = append(buttons, replyMarkup.Data(topic.Topic, btnRepliesTopic.Unique, data))
 	}
 	replyMarkup.Inline(buttons)
 
 	_, err = b.client.Send(ctx.Recipient(), "Выберите топик для показа сообщений", replyMarkup)
+	return err
+}
+
+func (b *Bot) handleRepliesTopicButton(ctx telebot.Context) error {
+	topicId, err := strconv.ParseInt(ctx.Callback().Data, 10, 64)
 	if err != nil {
-		return err
+		log.Errorf("invalid data in inline keyboard callback: '%s'", ctx.Callback().Data)
+		return b.handleExpiredCallback(ctx)
 	}
-
-	for _, button := range buttons {
-		b.client.Handle(button.CallbackUnique(), func(ctx telebot.Context) error {
-			data := strings.Split(ctx.Callback().Data, "|")
-			if len(data) == 0 {
-				return ctx.Respond()
-			}
-
-			topicId, err := strconv.ParseInt(data[0], 10, 64)
-			if err != nil {
-				return err
-			}
-
-			topic, err := b.db.GetUserTopicById(topicId)
-			if err != nil {
-				return err
-			}
-
-			_ = ctx.Respond()
-
-			return b.showRepliesPaging(ctx, topic.Topic, "")
-		})
+	topic, err := b.db.GetUserTopicById(topicId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && topic.SenderTGId != senderOrgId(ctx)) {
+		return b.handleExpiredCallback(ctx)
+	}
+	if err != nil {
+		return err
 	}
 
-	return nil
+	_ = ctx.Respond()
+	return b.showRepliesPaging(ctx, senderOrgId(ctx), topic.Topic, "")
 }
 
-// command: /show_replies_old <topic> [search_query_word]
+// command: /show_replies_old <topic> [search query]
 func (b *Bot) handleShowRepliesOld(ctx telebot.Context) error {
 	args := ctx.Args()
-	if len(args) < 1 || len(args) > 2 {
-		return ctx.Send("command should be in format /show_replies <topic> [search_query_word]")
+	if len(args) < 1 {
+		return ctx.Send("command should be in format /show_replies_old <topic> [search query]")
 	}
 	topicName := args[0]
-	searchQuery := ""
-	if len(args) == 2 {
-		searchQuery = args[1]
-	}
+	searchQuery := strings.Join(args[1:], " ")
 
-	err := b.showRepliesPaging(ctx, topicName, searchQuery)
+	err := b.showRepliesPaging(ctx, senderOrgId(ctx), topicName, searchQuery)
 	return err
 }
 
-func (b *Bot) showRepliesPaging(ctx telebot.Context, topicName, searchQuery string) error {
-	page := 1
-	const pagingBy = 5
-	var allReplies []models.Message
-	var totalPages int
-	tgMessages := make([]*telebot.Message, 0, pagingBy)
+const repliesPagingBy = 5
 
-	sendOrUpdateMessages := func() error {
-		topic, err := b.db.GetTopicByTopicNameAndSender(topicName, ctx.Chat().ID)
-		if err != nil {
-			return err
-		}
-		messages, err := b.db.GetMessagesByTopicIdFromRecipient(topic.TopicId)
-		if err != nil {
-			return err
-		}
-		allReplies = messages
-		if searchQuery != "" {
-			n := 0
-			for _, msg := range allReplies {
-				if strings.Contains(msg.Message, searchQuery) {
-					allReplies[n] = msg
-					n++
-				}
-			}
-			allReplies = allReplies[:n]
-		}
-		totalPages = len(allReplies) / pagingBy
-		if len(allReplies)%pagingBy != 0 {
-			totalPages++
-		}
-
-		currIdx := 0
-		for i := (page - 1) * pagingBy; i < page*pagingBy && i < len(allReplies); i++ {
-			reply := allReplies[i]
-			recipients, err := b.db.GetRecipientsByIds([]int64{reply.RecipientId})
-			if err != nil {
-				return err
-			}
-			tgName := recipients[0].RecipientTGName
-
-			const timeLayout = "2006-01-02 15:04:05"
-			messageText := fmt.Sprintf("@%s (%s):\n\n%s", tgName, reply.SendDateTime.Format(timeLayout), reply.Message)
-			var message *telebot.Message
-			if currIdx >= len(tgMessages) {
-				message, err = b.client.Send(ctx.Recipient(), messageText)
-				if err != nil {
-					return err
-				}
-				tgMessages = append(tgMessages, message)
-			} else {
-				message = tgMessages[currIdx]
-				message, err = b.client.Edit(message, messageText)
-				if err != nil {
-					return err
-				}
-			}
-			currIdx++
+// repliesPaging is a callback state of replies paging keyboard.
+type repliesPaging struct {
+	TopicId     int64  `json:"topic_id"`
+	SearchQuery string `json:"search_query,omitempty"`
+	// messages above the keyboard that show replies of the current page
+	MessageIds []int `json:"message_ids"`
+}
 
-			b.showRepliesPagingStateLock.Lock()
-			b.showRepliesPagingState[message.ID] = reply
-			b.showRepliesPagingStateLock.Unlock()
-		}
-		// clear messages on last page
-		for _, message := range tgMessages[currIdx:] {
-			_, err := b.client.Edit(message, "-")
-			if err != nil {
-				return err
-			}
-		}
-		return nil
+func (b *Bot) showRepliesPaging(ctx telebot.Context, orgId int64, topicName, searchQuery string) error {
+	topic, err := b.db.GetTopicByTopicNameAndSender(topicName, orgId)
+	if err != nil {
+		return err
+	}
+	paging := repliesPaging{TopicId: topic.TopicId, SearchQuery: searchQuery}
+	_, totalPages, err := b.showRepliesPage(ctx.Chat().ID, &paging, 1)
+	if err != nil {
+		return err
 	}
 
-	h := xxhash.New()
-	_ = binary.Write(h, binary.BigEndian, ctx.Chat().ID)
-	sumBytes := h.Sum([]byte(topicName))
-	uniquePrefix := base64.URLEncoding.EncodeToString(sumBytes)
-	uniquePrefix = strings.TrimSuffix(uniquePrefix, "==")
-
-	makeReplyMarkup := func() *telebot.ReplyMarkup {
-		prevPage := page - 1
-		if prevPage <= 0 {
-			prevPage = 1
-		}
-		nextPage := page + 1
-		if nextPage > totalPages {
-			nextPage = totalPages
-		} else if nextPage == 0 {
-			nextPage = 1
-		}
-		var replyMarkup = &telebot.ReplyMarkup{}
-		var btnFirst = replyMarkup.Data("«1", uniquePrefix+"_first", "1")
-		var btnPrev = replyMarkup.Data(fmt.Sprintf("< %d", prevPage), uniquePrefix+"_prev", strconv.Itoa(prevPage))
-		if prevPage == page {
-			btnPrev = replyMarkup.Data("-", uniquePrefix+"_prev")
-		}
-		var btnCurr = replyMarkup.Data(fmt.Sprintf("· %d ·", page), uniquePrefix+"_curr")
-		var btnNext = replyMarkup.Data(fmt.Sprintf("%d >", nextPage), uniquePrefix+"_next", strconv.Itoa(nextPage))
-		if nextPage == page {
-			btnNext = replyMarkup.Data("-", uniquePrefix+"_next")
-		}
-		var btnLast = replyMarkup.Data(fmt.Sprintf("%d »", totalPages), uniquePrefix+"_last", strconv.Itoa(totalPages))
-		replyMarkup.Inline(replyMarkup.Row(btnFirst, btnPrev, btnCurr, btnNext, btnLast))
-
-		return replyMarkup
+	token, err := b.saveCallbackState("", ctx.Chat().ID, paging)
+	if err != nil {
+		return err
 	}
+	str := fmt.Sprintf("Сообщения по топику '%s'. Выбери страницу", topic.Topic)
+	_, err = b.client.Send(ctx.Recipient(), str, repliesPagingMarkup(token, 1, totalPages))
+	return err
+}
 
-	err := sendOrUpdateMessages()
+// callback data: <token>|<page>
+func (b *Bot) handleRepliesPageButton(ctx telebot.Context) error {
+	data := strings.Split(ctx.Callback().Data, "|")
+	if len(data) != 2 {
+		log.Errorf("invalid data in inline keyboard callback: '%s'", ctx.Callback().Data)
+		return b.handleExpiredCallback(ctx)
+	}
+	token := data[0]
+	page, err := strconv.Atoi(data[1])
+	if err != nil {
+		log.Errorf("invalid data in inline keyboard callback: '%s'", ctx.Callback().Data)
+		return b.handleExpiredCallback(ctx)
+	}
+	paging := repliesPaging{}
+	ok, err := b.loadCallbackState(ctx, token, &paging)
+	if err != nil || !ok {
+		return err
+	}
+	topic, err := b.db.GetUserTopicById(paging.TopicId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && topic.SenderTGId != senderOrgId(ctx)) {
+		return b.handleExpiredCallback(ctx)
+	}
 	if err != nil {
 		return err
 	}
 
-	str := fmt.Sprintf("Сообщения по топику '%s'. Выбери страницу", topicName)
-	keyboardMessage, err := b.client.Send(ctx.Recipient(), str, makeReplyMarkup())
+	page, totalPages, err := b.showRepliesPage(ctx.Chat().ID, &paging, page)
 	if err != nil {
 		return err
 	}
+	_, err = b.saveCallbackState(token, ctx.Chat().ID, paging)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.EditReplyMarkup(ctx.Message(), repliesPagingMarkup(token, page, totalPages))
+	if err != nil && !isNotModified(err) {
+		return err
+	}
+	return ctx.Respond()
+}
 
-	for _, btn := range makeReplyMarkup().InlineKeyboard[0] {
-		b.client.Handle(btn.CallbackUnique(), func(ctx telebot.Context) error {
-			data := strings.Split(ctx.Callback().Data, "|")
-			if len(data) == 0 {
-				return ctx.Respond()
-			}
-			newPage, err := strconv.Atoi(data[0])
+// showRepliesPage sends or updates paging messages to show the page, out of range page is moved to the nearest one.
+func (b *Bot) showRepliesPage(chatId int64, paging *repliesPaging, page int) (shownPage, totalPages int, err error) {
+	count, err := b.db.CountRecipientMessages(paging.TopicId, paging.SearchQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	totalPages = count / repliesPagingBy
+	if count%repliesPagingBy != 0 {
+		totalPages++
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+	if page < 1 {
+		page = 1
+	}
+	replies, err := b.db.GetRecipientMessagesPage(paging.TopicId, paging.SearchQuery, repliesPagingBy, (page-1)*repliesPagingBy)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	currIdx := 0
+	for _, reply := range replies {
+		recipients, err := b.db.GetRecipientsByIds([]int64{reply.RecipientId})
+		if err != nil {
+			return 0, 0, err
+		}
+		const timeLayout = "2006-01-02 15:04:05"
+		messageText := fmt.Sprintf("%s (%s):\n\n%s", recipientTitle(recipients[0]), reply.SendDateTime.Format(timeLayout), storedContent(reply).Preview())
+		markup := threadMarkup(reply.TopicId, reply.RecipientId)
+		var message *telebot.Message
+		if currIdx >= len(paging.MessageIds) {
+			message, err = b.client.Send(telebot.ChatID(chatId), messageText, markup)
 			if err != nil {
-				log.Errorf("invalid data in inline keyboard callback: '%s'", ctx.Callback().Data)
-				return ctx.Respond()
+				return 0, 0, err
 			}
-
-			// this will re-calculate totalPages
-			_ = sendOrUpdateMessages()
-
-			page = newPage
-			if page > totalPages {
-				page = totalPages
+			paging.MessageIds = append(paging.MessageIds, message.ID)
+		} else {
+			message = &telebot.Message{ID: paging.MessageIds[currIdx], Chat: &telebot.Chat{ID: chatId}}
+			_, err = b.client.Edit(message, messageText, markup)
+			if err != nil && !isNotModified(err) {
+				return 0, 0, err
 			}
+		}
+		currIdx++
 
-			_ = sendOrUpdateMessages()
-			_, _ = b.client.EditReplyMarkup(keyboardMessage, makeReplyMarkup())
-
-			return ctx.Respond()
+		err = b.db.SavePagedMessage(models.PagedMessage{
+			ChatId:      chatId,
+			MessageTGId: int64(message.ID),
+			MessageId:   reply.MessageId,
+			ShownAt:     time.Now(),
 		})
+		if err != nil {
+			return 0, 0, err
+		}
 	}
-
-	return nil
+	// clear messages on last page
+	for _, id := range paging.MessageIds[currIdx:] {
+		_, err := b.client.Edit(&telebot.Message{ID: id, Chat: &telebot.Chat{ID: chatId}}, "-")
+		if err != nil && !isNotModified(err) {
+			return 0, 0, err
+		}
+	}
+	return page, totalPages, nil
 }
 
-func (b *Bot) handleNotificationsConfig(ctx telebot.Context) error {
-	uniquePrefix := strconv.FormatInt(ctx.Chat().ID, 10)
-
-	var replyMarkup = &telebot.ReplyMarkup{}
-	var btnOn = replyMarkup.Data("Включить", uniquePrefix+"_notif_on")
-	var btnOff = replyMarkup.Data("Отключить", uniquePrefix+"_notif_off")
-	replyMarkup.Inline(replyMarkup.Row(btnOn, btnOff))
-
-	_, err := b.client.Send(ctx.Recipient(), "Выберите настройки уведомлений", replyMarkup)
-	if err != nil {
-		return err
+func repliesPagingMarkup(token string, page, totalPages int) *telebot.ReplyMarkup {
+	prevPage := page - 1
+	if prevPage <= 0 {
+		prevPage = 1
+	}
+	nextPage := page + 1
+	if nextPage > totalPages {
+		nextPage = totalPages
+	} else if nextPage == 0 {
+		nextPage = 1
+	}
+	pageData := func(page int) string {
+		return fmt.Sprintf("%s|%d", token, page)
 	}
-	b.client.Handle(btnOn.CallbackUnique(), func(ctx telebot.Context) error {
-		err := b.db.SetNotificationsConfig(ctx.Chat().ID, true)
-		if err != nil {
-			return err
-		}
-		return ctx.Respond()
-	})
-	b.client.Handle(btnOff.CallbackUnique(), func(ctx telebot.Context) error {
-		err := b.db.SetNotificationsConfig(ctx.Chat().ID, false)
-		if err != nil {
-			return err
-		}
-		return ctx.Respond()
-	})
 
-	return nil
+	var replyMarkup = &telebot.ReplyMarkup{}
+	var btnFirst = replyMarkup.Data("«1", btnRepliesPage.Unique, pageData(1))
+	var btnPrev = replyMarkup.Data(fmt.Sprintf("< %d", prevPage), btnRepliesPage.Unique, pageData(prevPage))
+	if prevPage == page {
+		btnPrev = replyMarkup.Data("-", btnRepliesPage.Unique, pageData(page))
+	}
+	var btnCurr = replyMarkup.Data(fmt.Sprintf("· %d ·", page), btnRepliesPage.Unique, pageData(page))
+	var btnNext = replyMarkup.Data(fmt.Sprintf("%d >", nextPage), btnRepliesPage.Unique, pageData(nextPage))
+	if nextPage == page {
+		btnNext = replyMarkup.Data("-", btnRepliesPage.Unique, pageData(page))
+	}
+	var btnLast = replyMarkup.Data(fmt.Sprintf("%d »", totalPages), btnRepliesPage.Unique, pageData(totalPages))
+	replyMarkup.Inline(replyMarkup.Row(btnFirst, btnPrev, btnCurr, btnNext, btnLast))
+	return replyMarkup
 }
 
-func (b *Bot) handleTopicsStats(ctx telebot.Context) error {
-	topics, err := b.db.GetUserTopicsBySender(ctx.Chat().ID)
+// command: /inactive
+func (b *Bot) handleInactiveRecipients(ctx telebot.Context) error {
+	recipients, err := b.db.GetInactiveRecipientsBySender(senderOrgId(ctx))
 	if err != nil {
 		return err
 	}
-
-	type Stats struct {
-		Sent, Received int
-	}
-
-	topicsStats := make(map[string]Stats)
-	for _, topic := range topics {
-		messages, err := b.db.GetMessagesByTopicId(topic.TopicId)
-		if err != nil {
-			return err
-		}
-		stat := Stats{}
-		for _, msg := range messages {
-			if msg.IsRecipientMessage == 0 {
-				stat.Sent++
-			} else {
-				stat.Received++
-			}
-		}
-		topicsStats[topic.Topic] = stat
+	if len(recipients) == 0 {
+		return ctx.Send("Все получатели из ваших списков активны")
 	}
 
-	sort.Slice(topics, func(i, j int) bool {
-		return topics[i].Topic < topics[j].Topic
-	})
-
 	str := new(strings.Builder)
-	str.WriteString("Статистика по топикам:")
-	for _, topic := range topics {
-		stat := topicsStats[topic.Topic]
-		_, _ = fmt.Fprintf(str, "\n%s: отправлено %d; получено %d", topic.Topic, stat.Sent, stat.Received)
+	str.WriteString("Неактивные получатели, рассылки им не отправляются, пока они снова не напишут боту /start:")
+	for _, recipient := range recipients {
+		_, _ = fmt.Fprintf(str, "\n%s - %s", recipientFullTitle(recipient), inactiveReasonName(recipient.InactiveReason))
 	}
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
 
-	return ctx.Send(str.String())
+func inactiveReasonName(reason string) string {
+	switch reason {
+	case models.RecipientInactiveBlocked:
+		return "заблокировал бота"
+	case models.RecipientInactiveDeactivated:
+		return "удалил аккаунт"
+	case models.RecipientInactiveNotFound:
+		return "чат не найден"
+	default:
+		return reason
+	}
 }
 
-// command: /send_messages <topic> <mailing_list_name>
+// command: /send_messages [-tmpl] <topic> <mailing_list> <message_body>
+// or as a reply to any message (text or media): /send_messages [-tmpl] <topic> <mailing_list>
+// mailing_list is list name or id, -tmpl renders the text for every recipient
 func (b *Bot) handleSendMessages(ctx telebot.Context) error {
-	args := ctx.Args()
-	if len(args) != 3 {
-		return ctx.Send("Пожалуйста, введите данные в формате /send_messages <IdТопика> <MailingListId> <MessageBody>")
+	args, tmpl := cutTemplateFlag(ctx.Args())
+	replyTo := ctx.Message().ReplyTo
+	if (replyTo == nil && len(args) < 3) || (replyTo != nil && len(args) != 2) {
+		return ctx.Send("Пожалуйста, введите данные в формате /send_messages [-tmpl] <IdТопика> <Список> <MessageBody> " +
+			"или ответьте на сообщение с фото, документом, видео или голосовым командой /send_messages [-tmpl] <IdТопика> <Список>\n" +
+			"С -tmpl в тексте подставляются {{.RecipientName}}, {{.TGName}} и поля из файла, импортированного командой /import_list\n" +
+			"Кнопки реакций добавляются только в рассылках через /broadcast")
 	}
 	topicName := args[0]
-	mailingListId, _ := strconv.ParseInt(args[1], 10, 64)
-	messageBody := args[2]
+	list, ok, err := b.findMailingList(ctx, args[1])
+	if err != nil || !ok {
+		return err
+	}
+	var content MessageContent
+	if replyTo != nil {
+		content = messageContent(replyTo)
+	} else {
+		// the body follows topic, list and the flag if it's given
+		content = MessageContent{Text: commandTail(ctx.Message().Text, len(ctx.Args())-len(args)+2)}
+	}
+	if content.IsEmpty() {
+		return ctx.Send("Это сообщение нельзя разослать")
+	}
+	content.Template = tmpl
 
 	topic, err := b.db.AddTopic(models.Topic{
-		SenderTGId: ctx.Chat().ID,
+		SenderTGId: senderOrgId(ctx),
 		Topic:      topicName,
 	})
 	if err != nil {
@@ -525,51 +736,67 @@ func (b *Bot) handleSendMessages(ctx telebot.Context) error {
 		return err
 	}
 
-	recipients, _ := b.db.GetMailingListRecipientsById(mailingListId)
+	broadcast, err := b.broadcast(senderOrgId(ctx), topic, list.ListId, content, false)
+	var tmplErr *templateError
+	if errors.As(err, &tmplErr) {
+		return ctx.Send(formatTemplateError(tmplErr))
+	}
+	if err != nil {
+		log.Errorf("send message: %v", err)
+		return err
+	}
 
-	for _, recipient := range recipients {
-		message, err := b.client.Send(telebot.ChatID(recipient.RecipientTGId), messageBody)
-		if err != nil {
-			log.Errorf("send message: %v", err)
-			return err
-		}
-		err = b.db.AddMessage(models.Message{
-			MessageTGId:        int64(message.ID),
-			SenderTGId:         ctx.Chat().ID,
-			RecipientId:        recipient.RecipientId,
-			TopicId:            topic.TopicId,
-			ListId:             mailingListId,
-			SendDateTime:       message.Time(),
-			Message:            message.Text,
-			React:              "",
-			Read:               0,
-			IsRecipientMessage: 0,
-		})
-		if err != nil {
-			log.Errorf("save message: %v", err)
-			return err
-		}
+	return ctx.Send(fmt.Sprintf("Рассылка #%d поставлена в очередь, отчет о доставке придет по завершении", broadcast.BroadcastId))
+}
+
+func (b *Bot) getOrAddTopic(senderTGId int64, topicName string) (models.Topic, error) {
+	topic, err := b.db.GetTopicByTopicNameAndSender(topicName, senderTGId)
+	if err == nil {
+		return topic, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return models.Topic{}, err
 	}
+	return b.db.AddTopic(models.Topic{SenderTGId: senderTGId, Topic: topicName})
+}
 
-	return ctx.Send("Пост отправлен!")
+// findTopic looks up sender's topic by name. If ok is false, user is already notified.
+func (b *Bot) findTopic(ctx telebot.Context, topicName string) (models.Topic, bool, error) {
+	topic, err := b.db.GetTopicByTopicNameAndSender(topicName, senderOrgId(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Topic{}, false, ctx.Send(fmt.Sprintf("Топик '%s' не найден, ваши топики: /topics_stats", topicName))
+	}
+	if err != nil {
+		return models.Topic{}, false, err
+	}
+	return topic, true, nil
 }
 
-func (b *Bot) handleAllTextMessages(ctx telebot.Context) error {
+func (b *Bot) handleAllMessages(ctx telebot.Context) error {
 	msg := ctx.Message()
-	if reply := msg.ReplyTo; reply != nil {
-		var message models.Message
-		var err error
-
-		b.showRepliesPagingStateLock.Lock()
-		message, exists := b.showRepliesPagingState[reply.ID]
-		b.showRepliesPagingStateLock.Unlock()
+	if msg.ReplyTo == nil {
+		handled, err := b.handleWizardMessage(ctx)
+		if handled {
+			return err
+		}
+	}
 
-		if !exists {
-			message, err = b.db.GetMessageByMessageId(int64(msg.ReplyTo.ID))
-			if err != nil {
-				log.Errorf("reply: get message: %v", err)
-				return err
-			}
+	content := messageContent(msg)
+	if reply := msg.ReplyTo; reply != nil {
+		message, err := b.db.GetMessageByPagedMessage(ctx.Chat().ID, int64(reply.ID))
+		if errors.Is(err, sql.ErrNoRows) {
+			// replies forwarded to organization members are looked up by their copy in member's chat
+			message, err = b.db.GetMessageByCopy(ctx.Chat().ID, int64(reply.ID))
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			message, err = b.sentMessage(ctx.Sender().ID, reply.ID)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			message, err = b.db.GetMessageByMessageId(int64(reply.ID))
+		}
+		if err != nil {
+			log.Errorf("reply: get message: %v", err)
+			return err
 		}
 		if message.ListId == 0 { //TODO add relevant check on reply to to unsaved message
 			return nil
@@ -577,25 +804,46 @@ func (b *Bot) handleAllTextMessages(ctx telebot.Context) error {
 
 		// TODO remove copy-paste
 		if message.IsRecipientMessage == 1 {
+			member, ok, err := b.orgMember(ctx)
+			if err != nil {
+				return err
+			}
+			if !ok || member.OrgId != message.SenderTGId {
+				return nil
+			}
+			if orgRoleLevels[member.Role] < orgRoleLevels[models.OrgRoleEditor] {
+				return ctx.Send(fmt.Sprintf("Недостаточно прав: отвечать получателям может роль %s, ваша роль %s", models.OrgRoleEditor, member.Role))
+			}
+
 			recipient, err := b.db.GetRecipientsByIds([]int64{message.RecipientId})
 			if err != nil {
 				log.Errorf("reply: get sender info: %v", err)
 				return err
 			}
-			sentMessage, err := b.client.Send(telebot.ChatID(recipient[0].RecipientTGId), msg.Text)
+			sentMessage, err := b.sendContent(telebot.ChatID(recipient[0].RecipientTGId), content)
+			if reason := recipientInactiveReason(err); reason != "" {
+				err = b.db.SetRecipientInactive(recipient[0].RecipientId, reason)
+				if err != nil {
+					log.Errorf("reply: deactivate recipient: %v", err)
+					return err
+				}
+				return ctx.Send(fmt.Sprintf("Не удалось отправить ответ: %s заблокировал бота или удалил аккаунт", recipientTitle(recipient[0])))
+			}
 			if err != nil {
 				log.Errorf("reply: send sender reply: %v", err)
 				return err
 			}
 
-			err = b.db.AddMessage(models.Message{
+			_, err = b.db.AddMessage(models.Message{
 				MessageTGId:        int64(sentMessage.ID),
-				SenderTGId:         ctx.Chat().ID,
+				SenderTGId:         message.SenderTGId,
 				RecipientId:        recipient[0].RecipientTGId,
 				TopicId:            message.TopicId,
 				ListId:             message.ListId,
 				SendDateTime:       sentMessage.Time(),
-				Message:            msg.Text,
+				Message:            content.Text,
+				MediaType:          content.MediaType,
+				FileId:             content.FileId,
 				Read:               0,
 				IsRecipientMessage: 0,
 			})
@@ -604,27 +852,35 @@ func (b *Bot) handleAllTextMessages(ctx telebot.Context) error {
 				return err
 			}
 		} else {
-			notifyEnabled, err := b.db.GetNotificationsConfig(message.SenderTGId)
+			settings, err := b.db.GetSenderSettings(message.SenderTGId)
 			if err != nil {
 				return err
 			}
-			mId := 0
-			if notifyEnabled {
-				sentMessage, err := b.client.Send(telebot.ChatID(message.SenderTGId), msg.Text)
+			var copies []*telebot.Message
+			if settings.NotificationsEnabled && !settings.DigestMode {
+				opts := &telebot.SendOptions{DisableNotification: settings.InQuietHours(time.Now())}
+				copies, err = b.sendToOrganization(message.SenderTGId, func(to telebot.Recipient) (*telebot.Message, error) {
+					return b.sendContent(to, content, opts)
+				})
 				if err != nil {
 					log.Errorf("reply: send recipient reply: %v", err)
 					return err
 				}
-				mId = sentMessage.ID
 			}
-			err = b.db.AddMessage(models.Message{
+			mId := 0
+			if len(copies) > 0 {
+				mId = copies[0].ID
+			}
+			saved, err := b.db.AddMessage(models.Message{
 				MessageTGId:        int64(mId),
 				SenderTGId:         message.SenderTGId,
 				RecipientId:        ctx.Chat().ID,
 				TopicId:            message.TopicId,
 				ListId:             message.ListId,
 				SendDateTime:       time.Now(),
-				Message:            msg.Text,
+				Message:            content.Text,
+				MediaType:          content.MediaType,
+				FileId:             content.FileId,
 				Read:               0,
 				IsRecipientMessage: 1,
 			})
@@ -632,11 +888,59 @@ func (b *Bot) handleAllTextMessages(ctx telebot.Context) error {
 				log.Errorf("reply: save recipient reply: %v", err)
 				return err
 			}
+			for _, c := range copies {
+				err = b.db.AddMessageCopy(models.MessageCopy{ChatId: c.Chat.ID, MessageTGId: int64(c.ID), MessageId: saved.MessageId})
+				if err != nil {
+					log.Errorf("reply: save recipient reply copy: %v", err)
+					return err
+				}
+			}
+			if message.Read == 0 {
+				err = b.db.MarkMessageRead(message.MessageId)
+				if err != nil {
+					log.Errorf("reply: mark message read: %v", err)
+					return err
+				}
+			}
 		}
 	}
 	return nil
 }
 
+// commandTail returns text after the command and n following arguments, keeping original spacing and newlines.
+func commandTail(text string, n int) string {
+	rest := strings.TrimSpace(text)
+	for i := 0; i <= n && rest != ""; i++ {
+		idx := strings.IndexFunc(rest, unicode.IsSpace)
+		if idx < 0 {
+			return ""
+		}
+		rest = strings.TrimLeftFunc(rest[idx:], unicode.IsSpace)
+	}
+	return rest
+}
+
+// runHandlers runs every handler in its own goroutine. The client is synchronous,
+// so the goroutine is counted before ProcessUpdate returns and Close doesn't miss it.
+func (b *Bot) runHandlers(next telebot.HandlerFunc) telebot.HandlerFunc {
+	return func(ctx telebot.Context) error {
+		b.handlersWg.Add(1)
+		go func() {
+			defer b.handlersWg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("telegram bot: handler panic: %v", r)
+				}
+			}()
+			err := next(ctx)
+			if err != nil {
+				b.client.OnError(err, ctx)
+			}
+		}()
+		return nil
+	}
+}
+
 func IgnoreNonPrivateMessages(next telebot.HandlerFunc) telebot.HandlerFunc {
 	return func(ctx telebot.Context) error {
 		msg := ctx.Message()
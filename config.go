@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "TFAHACK_"
+
+type Config struct {
+	APIToken     string   `yaml:"api_token" json:"api_token" toml:"api_token"`
+	AdminIDs     []int64  `yaml:"admin_ids" json:"admin_ids" toml:"admin_ids"` // users allowed to create organizations, empty means anyone
+	LogAllEvents bool     `yaml:"log_all_events" json:"log_all_events" toml:"log_all_events"`
+	LogLevel     string   `yaml:"log_level" json:"log_level" toml:"log_level"`
+	DBPath       string   `yaml:"db_path" json:"db_path" toml:"db_path"`
+	PollTimeout  Duration `yaml:"poll_timeout" json:"poll_timeout" toml:"poll_timeout"`
+	// how often replies are summarized for senders in digest mode
+	DigestInterval Duration `yaml:"digest_interval" json:"digest_interval" toml:"digest_interval"`
+	// unfinished broadcast wizard is cancelled after this period of inactivity
+	WizardTimeout Duration `yaml:"wizard_timeout" json:"wizard_timeout" toml:"wizard_timeout"`
+	// /show_replies pages and inline keyboards stop working after this period
+	PagingStateTTL Duration `yaml:"paging_state_ttl" json:"paging_state_ttl" toml:"paging_state_ttl"`
+	// webhook mode is enabled by listen address of the built-in server, e.g. ":8443", empty means long polling
+	WebhookListen string `yaml:"webhook_listen" json:"webhook_listen" toml:"webhook_listen"`
+	// public https url registered in telegram, its path is served; empty means the webhook is registered elsewhere
+	WebhookURL string `yaml:"webhook_url" json:"webhook_url" toml:"webhook_url"`
+	// telegram sends it in X-Telegram-Bot-Api-Secret-Token header, requests without it are rejected
+	WebhookSecret string `yaml:"webhook_secret" json:"webhook_secret" toml:"webhook_secret"`
+	// certificate and key for https, without them plain http is served (e.g. behind a reverse proxy)
+	WebhookTLSCert string `yaml:"webhook_tls_cert" json:"webhook_tls_cert" toml:"webhook_tls_cert"`
+	WebhookTLSKey  string `yaml:"webhook_tls_key" json:"webhook_tls_key" toml:"webhook_tls_key"`
+}
+
+// Duration is a time.Duration that can be decoded from strings like "10s" in every supported config format.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		LogAllEvents:   true,
+		LogLevel:       "info",
+		DBPath:         "./sqlite.db",
+		PollTimeout:    Duration{10 * time.Second},
+		DigestInterval: Duration{time.Hour},
+		WizardTimeout:  Duration{30 * time.Minute},
+		PagingStateTTL: Duration{30 * 24 * time.Hour},
+	}
+}
+
+// LoadConfig reads config from path (YAML, TOML or JSON, chosen by extension) and applies
+// TFAHACK_* environment overrides. Empty path means env and defaults only.
+// The result isn't validated: the bot needs Validate, the migrate command only ValidateDB.
+func LoadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		err := readConfigFile(path, &cfg)
+		if err != nil {
+			return Config{}, fmt.Errorf("read config file '%s': %v", path, err)
+		}
+	}
+
+	err := applyEnv(&cfg)
+	if err != nil {
+		return Config{}, fmt.Errorf("apply env: %v", err)
+	}
+
+	return cfg, nil
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, cfg)
+	case ".toml":
+		return toml.Unmarshal(data, cfg)
+	case ".json":
+		return json.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("unsupported config format '%s', expected .yaml, .toml or .json", ext)
+	}
+}
+
+func applyEnv(cfg *Config) error {
+	if v, ok := os.LookupEnv(envPrefix + "API_TOKEN"); ok {
+		cfg.APIToken = v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "ADMIN_IDS"); ok {
+		ids, err := parseIDs(v)
+		if err != nil {
+			return fmt.Errorf("%sADMIN_IDS: %v", envPrefix, err)
+		}
+		cfg.AdminIDs = ids
+	}
+	if v, ok := os.LookupEnv(envPrefix + "LOG_ALL_EVENTS"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sLOG_ALL_EVENTS: %v", envPrefix, err)
+		}
+		cfg.LogAllEvents = b
+	}
+	if v, ok := os.LookupEnv(envPrefix + "LOG_LEVEL"); ok {
+		cfg.LogLevel = v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "DB_PATH"); ok {
+		cfg.DBPath = v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "POLL_TIMEOUT"); ok {
+		err := cfg.PollTimeout.UnmarshalText([]byte(v))
+		if err != nil {
+			return fmt.Errorf("%sPOLL_TIMEOUT: %v", envPrefix, err)
+		}
+	}
+	if v, ok := os.LookupEnv(envPrefix + "DIGEST_INTERVAL"); ok {
+		err := cfg.DigestInterval.UnmarshalText([]byte(v))
+		if err != nil {
+			return fmt.Errorf("%sDIGEST_INTERVAL: %v", envPrefix, err)
+		}
+	}
+	if v, ok := os.LookupEnv(envPrefix + "WIZARD_TIMEOUT"); ok {
+		err := cfg.WizardTimeout.UnmarshalText([]byte(v))
+		if err != nil {
+			return fmt.Errorf("%sWIZARD_TIMEOUT: %v", envPrefix, err)
+		}
+	}
+	if v, ok := os.LookupEnv(envPrefix + "PAGING_STATE_TTL"); ok {
+		err := cfg.PagingStateTTL.UnmarshalText([]byte(v))
+		if err != nil {
+			return fmt.Errorf("%sPAGING_STATE_TTL: %v", envPrefix, err)
+		}
+	}
+	if v, ok := os.LookupEnv(envPrefix + "WEBHOOK_LISTEN"); ok {
+		cfg.WebhookListen = v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "WEBHOOK_URL"); ok {
+		cfg.WebhookURL = v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "WEBHOOK_SECRET"); ok {
+		cfg.WebhookSecret = v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "WEBHOOK_TLS_CERT"); ok {
+		cfg.WebhookTLSCert = v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "WEBHOOK_TLS_KEY"); ok {
+		cfg.WebhookTLSKey = v
+	}
+
+	return nil
+}
+
+// parseIDs parses comma-separated telegram ids, e.g. "123,456".
+func parseIDs(s string) ([]int64, error) {
+	ids := make([]int64, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id '%s'", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ValidateDB checks settings the migrate command needs.
+func (cfg Config) ValidateDB() error {
+	if cfg.DBPath == "" {
+		return errors.New("db_path must not be empty")
+	}
+	return nil
+}
+
+func (cfg Config) Validate() error {
+	var errs []string
+	if cfg.APIToken == "" {
+		errs = append(errs, fmt.Sprintf("api_token is required (set it in config or %sAPI_TOKEN)", envPrefix))
+	}
+	if err := cfg.ValidateDB(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if cfg.PollTimeout.Duration <= 0 {
+		errs = append(errs, "poll_timeout must be positive")
+	}
+	if cfg.DigestInterval.Duration <= 0 {
+		errs = append(errs, "digest_interval must be positive")
+	}
+	if cfg.WizardTimeout.Duration <= 0 {
+		errs = append(errs, "wizard_timeout must be positive")
+	}
+	if cfg.PagingStateTTL.Duration <= 0 {
+		errs = append(errs, "paging_state_ttl must be positive")
+	}
+	if cfg.WebhookListen != "" {
+		if cfg.WebhookURL != "" {
+			if u, err := url.Parse(cfg.WebhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				errs = append(errs, "webhook_url must be an absolute https url")
+			}
+		}
+		if err := validateWebhookSecret(cfg.WebhookSecret); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook_secret: %v", err))
+		}
+		if (cfg.WebhookTLSCert == "") != (cfg.WebhookTLSKey == "") {
+			errs = append(errs, "webhook_tls_cert and webhook_tls_key must be set together")
+		}
+	}
+	if _, err := log.ParseLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, fmt.Sprintf("log_level: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -3,8 +3,9 @@ package db
 import (
 	"context"
 	"database/sql"
-	_ "embed"
-	"sync"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pymq/tfahack/models"
@@ -15,20 +16,43 @@ import (
 	"github.com/uptrace/bun/extra/bundebug"
 )
 
-//go:embed init_struct.sql
-var initStructQuery string
-
 type DB struct {
 	db *bun.DB
-	// TODO: store in db
-	notificationsConfig     map[int64]bool
-	notificationsConfigLock sync.Mutex
 }
 
-func NewDB() (*DB, error) {
-	sqldb, err := sql.Open(sqliteshim.ShimName, "./sqlite.db")
+func NewDB(path string) (*DB, error) {
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	group, err := migrator.Migrate(context.Background())
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("apply migrations: %v", err)
+	}
+	if !group.IsZero() {
+		log.Infof("applied migrations: %s", group)
+	}
+
+	return &DB{db: db}, nil
+}
+
+// busyTimeout makes a write wait for another connection's transaction instead of failing with "database is locked".
+// Both drivers of sqliteshim are configured, each ignores the other's parameter.
+const busyTimeout = "_pragma=busy_timeout(5000)&_busy_timeout=5000"
+
+func open(path string) (*bun.DB, error) {
+	dsn := path + "?" + busyTimeout
+	if strings.Contains(path, "?") {
+		dsn = path + "&" + busyTimeout
+	}
+	sqldb, err := sql.Open(sqliteshim.ShimName, dsn)
+	if err != nil {
+		return nil, err
 	}
 
 	db := bun.NewDB(sqldb, sqlitedialect.New())
@@ -39,12 +63,7 @@ func NewDB() (*DB, error) {
 		bundebug.FromEnv("BUNDEBUG"),
 	))
 
-	_, err = db.Exec(initStructQuery)
-	if err != nil {
-		return nil, err
-	}
-
-	return &DB{db: db, notificationsConfig: make(map[int64]bool)}, nil
+	return db, nil
 }
 
 func (db *DB) Close() {
@@ -54,9 +73,19 @@ func (db *DB) Close() {
 	}
 }
 
-func (db *DB) AddRecipient(recipient models.Recipient) error {
-	_, err := db.db.NewInsert().Model(&recipient).Exec(context.Background())
-	return err
+// AddRecipient saves a new recipient, if another recipient still holds the username it's moved to their history.
+func (db *DB) AddRecipient(recipient models.Recipient) (models.Recipient, error) {
+	err := db.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		if recipient.RecipientTGName != "" {
+			err := releaseUsername(ctx, tx, recipient.RecipientTGName, recipient.RecipientId, time.Now())
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.NewInsert().Model(&recipient).Exec(ctx)
+		return err
+	})
+	return recipient, err
 }
 
 func (db *DB) GetRecipientsByIds(tgIds []int64) ([]models.Recipient, error) {
@@ -68,15 +97,128 @@ func (db *DB) GetRecipientsByIds(tgIds []int64) ([]models.Recipient, error) {
 	return recipients, nil
 }
 
+// GetRecipientsByTGNames finds recipients by usernames ignoring case, as telegram does.
 func (db *DB) GetRecipientsByTGNames(tgNames []string) ([]models.Recipient, error) {
 	recipients := make([]models.Recipient, 0)
-	err := db.db.NewSelect().Model(&recipients).Where("recipient.RecipientTGName in (?)", bun.In(tgNames)).Scan(context.Background())
+	err := db.db.NewSelect().Model(&recipients).Where("lower(recipient.RecipientTGName) in (?)", bun.In(lowerAll(tgNames))).Scan(context.Background())
 	if err != nil {
 		return nil, err
 	}
 	return recipients, nil
 }
 
+// UpdateRecipientProfile saves new name and username, previous username goes to the history.
+// If another recipient still holds the username, they have changed it since, so it's moved to their history.
+func (db *DB) UpdateRecipientProfile(recipient models.Recipient, name, username string) error {
+	return db.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		now := time.Now()
+		if username != recipient.RecipientTGName && username != "" {
+			err := releaseUsername(ctx, tx, username, recipient.RecipientId, now)
+			if err != nil {
+				return err
+			}
+		}
+		if username != recipient.RecipientTGName && recipient.RecipientTGName != "" {
+			err := addUsernameHistory(ctx, tx, recipient.RecipientId, recipient.RecipientTGName, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.NewUpdate().
+			Model((*models.Recipient)(nil)).
+			Set("RecipientName = (?)", name).
+			Set("RecipientTGName = (?)", username).
+			Where("RecipientId = (?)", recipient.RecipientId).
+			Exec(ctx)
+		return err
+	})
+}
+
+// releaseUsername takes the username away from other recipients, they have changed it since it was saved.
+// The username goes to their history, so that lists can still find them by it.
+func releaseUsername(ctx context.Context, tx bun.Tx, username string, recipientId int64, now time.Time) error {
+	previousOwners := make([]models.Recipient, 0)
+	err := tx.NewSelect().
+		Model(&previousOwners).
+		Where("lower(recipient.RecipientTGName) = lower(?)", username).
+		Where("recipient.RecipientId != (?)", recipientId).
+		Scan(ctx)
+	if err != nil {
+		return err
+	}
+	for _, owner := range previousOwners {
+		err = addUsernameHistory(ctx, tx, owner.RecipientId, owner.RecipientTGName, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().
+			Model((*models.Recipient)(nil)).
+			Set("RecipientTGName = ''").
+			Where("RecipientId = (?)", owner.RecipientId).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addUsernameHistory(ctx context.Context, tx bun.Tx, recipientId int64, username string, replacedAt time.Time) error {
+	_, err := tx.NewInsert().
+		Model(&models.RecipientUsername{RecipientId: recipientId, Username: username, ReplacedAt: replacedAt}).
+		On("CONFLICT (RecipientId, Username) DO UPDATE").
+		Set("ReplacedAt = EXCLUDED.ReplacedAt").
+		Exec(ctx)
+	return err
+}
+
+// GetRecipientsByOldTGNames returns recipients by their previous usernames, the latest owner of every username wins.
+func (db *DB) GetRecipientsByOldTGNames(tgNames []string) (map[string]models.Recipient, error) {
+	history := make([]models.RecipientUsername, 0)
+	err := db.db.NewSelect().
+		Model(&history).
+		Where("lower(recipientUsername.Username) IN (?)", bun.In(lowerAll(tgNames))).
+		Order("recipientUsername.ReplacedAt").
+		Scan(context.Background())
+	if err != nil || len(history) == 0 {
+		return map[string]models.Recipient{}, err
+	}
+
+	recipientsIds := make([]int64, len(history))
+	for i, entry := range history {
+		recipientsIds[i] = entry.RecipientId
+	}
+	recipients := make([]models.Recipient, 0)
+	err = db.db.NewSelect().
+		Model(&recipients).
+		Where("recipient.RecipientId IN (?)", bun.In(recipientsIds)).
+		Scan(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[int64]models.Recipient, len(recipients))
+	for _, recipient := range recipients {
+		byId[recipient.RecipientId] = recipient
+	}
+
+	byName := make(map[string]models.Recipient, len(history))
+	for _, entry := range history {
+		if recipient, ok := byId[entry.RecipientId]; ok {
+			byName[entry.Username] = recipient
+		}
+	}
+	return byName, nil
+}
+
+func lowerAll(strs []string) []string {
+	lower := make([]string, len(strs))
+	for i, s := range strs {
+		lower[i] = strings.ToLower(s)
+	}
+	return lower
+}
+
 func (db *DB) AddMailingList(mList models.MailingList, recipientsIds []int64) error {
 	_, err := db.db.NewInsert().Model(&mList).Exec(context.Background())
 	if err != nil {
@@ -93,14 +235,15 @@ func (db *DB) AddMailingList(mList models.MailingList, recipientsIds []int64) er
 }
 
 func (db *DB) GetMailingListBySender(senderTGId int64) ([]models.MailingList, error) {
-	mList := make([]models.MailingList, 1)
+	mList := make([]models.MailingList, 0)
 	err := db.db.NewSelect().
 		Model(&mList).
-		Where("MailingList.SenderTGId = (?)", senderTGId).
+		Where("mailingList.SenderTGId = (?)", senderTGId).
 		Scan(context.Background())
 	return mList, err
 }
 
+// GetMailingListRecipientsById returns list members that didn't unsubscribe globally, from the list or from its sender.
 func (db *DB) GetMailingListRecipientsById(listId int64) ([]models.Recipient, error) {
 	recipients := make([]models.Recipient, 0)
 	mList := models.MailingList{}
@@ -109,9 +252,17 @@ func (db *DB) GetMailingListRecipientsById(listId int64) ([]models.Recipient, er
 		Column("RecipientId").
 		Join("LEFT JOIN MailingListRelations ON mailingList.ListId = MailingListRelations.ListId").
 		Where("mailingList.ListId = (?)", listId)
+	optedOutIds := db.db.NewSelect().
+		Model((*models.OptOut)(nil)).
+		Column("optOut.RecipientId").
+		Join("JOIN MailingList ON MailingList.SenderTGId = optOut.SenderTGId").
+		Where("MailingList.ListId = (?)", listId).
+		Where("optOut.ListId IN (0, ?)", listId)
 	err := db.db.NewSelect().
 		Model(&recipients).
 		Where("recipientId IN(?)", respondersIds).
+		Where("recipientId NOT IN(?)", optedOutIds).
+		Where("recipient.Unsubscribed = (?)", false).
 		Scan(context.Background())
 	return recipients, err
 }
@@ -139,11 +290,11 @@ func (db *DB) GetUserTopicById(topicId int64) (models.Topic, error) {
 	return topic, err
 }
 
-func (db *DB) AddMessage(message models.Message) error {
+func (db *DB) AddMessage(message models.Message) (models.Message, error) {
 	_, localeOffset := message.SendDateTime.Zone()
 	message.SendDateTime = message.SendDateTime.Add(time.Second * time.Duration(localeOffset))
 	_, err := db.db.NewInsert().Model(&message).Exec(context.Background())
-	return err
+	return message, err
 }
 
 func (db *DB) GetTopicByTopicNameAndSender(topicName string, senderTGId int64) (models.Topic, error) {
@@ -156,25 +307,370 @@ func (db *DB) GetTopicByTopicNameAndSender(topicName string, senderTGId int64) (
 	return topic, err
 }
 
-func (db *DB) GetMessagesByTopicId(topicId int64) ([]models.Message, error) {
-	messages := make([]models.Message, 0)
+// TopicStats are aggregated messages of a topic, or of a mailing list within the topic if ListId is set.
+type TopicStats struct {
+	TopicId  int64  `bun:"TopicId"`
+	Topic    string `bun:"Topic"`
+	ListId   int64  `bun:"ListId"`
+	ListName string `bun:"ListName"` // empty for deleted lists
+
+	// Sent messages to recipients, Received replies from them
+	Sent     int `bun:"Sent"`
+	Received int `bun:"Received"`
+	Media    int `bun:"Media"`
+	Read     int `bun:"Read"`
+	Reacted  int `bun:"Reacted"`
+	// Reached recipients got at least one message, Responded of them replied after the first one
+	Reached   int `bun:"Reached"`
+	Responded int `bun:"Responded"`
+	// MedianReplySeconds is median time from the first message to recipient's first reply, NULL if nobody replied
+	MedianReplySeconds sql.NullFloat64 `bun:"MedianReplySeconds"`
+}
+
+// messageRecipientId is RecipientId of the recipient the message was sent to or received from.
+// Broadcasts keep RecipientId of the recipient, replies in both directions keep recipient's telegram id.
+// A message could match one recipient by telegram id and another one by RecipientId, telegram id wins then.
+const messageRecipientId = `COALESCE(
+	(SELECT r.RecipientId FROM Recipients AS r WHERE r.RecipientTGId = message.RecipientId),
+	CASE WHEN message.IsRecipientMessage = 0 THEN message.RecipientId END)`
+
+// joinMessageRecipient joins the recipient of the message as "recipient", see messageRecipientId.
+func joinMessageRecipient(q *bun.SelectQuery) *bun.SelectQuery {
+	return q.Join("LEFT JOIN Recipients AS recipient ON recipient.RecipientId = " + messageRecipientId)
+}
+
+// whereMessageRecipient keeps messages sent to or received from the recipient, see messageRecipientId.
+func whereMessageRecipient(recipientId int64) func(q *bun.SelectQuery) *bun.SelectQuery {
+	return func(q *bun.SelectQuery) *bun.SelectQuery {
+		return q.Where(messageRecipientId+" = (?)", recipientId)
+	}
+}
+
+// statsMessagesQuery selects sender's messages sent in [from, to) with recipients identified by telegram id.
+// SendDateTime holds local time, so from and to are local time in UTC location. Zero from or to isn't limited.
+func (db *DB) statsMessagesQuery(senderTGId int64, from, to time.Time) *bun.SelectQuery {
+	q := db.db.NewSelect().
+		ModelTableExpr("Messages AS message").
+		ColumnExpr("message.TopicId, message.ListId, message.IsRecipientMessage, message.MediaType, message.Read").
+		ColumnExpr("COALESCE(message.React, '') AS React").
+		ColumnExpr("julianday(message.SendDateTime) AS SentAt").
+		ColumnExpr("COALESCE(recipient.RecipientTGId, message.RecipientId) AS RecipientTGId").
+		Join("JOIN Topics AS topic ON topic.TopicId = message.TopicId").
+		Apply(joinMessageRecipient).
+		Where("topic.SenderTGId = (?)", senderTGId)
+	if !from.IsZero() {
+		q = q.Where("julianday(message.SendDateTime) >= julianday(?)", from)
+	}
+	if !to.IsZero() {
+		q = q.Where("julianday(message.SendDateTime) < julianday(?)", to)
+	}
+	return q
+}
+
+// GetTopicStats aggregates sender's messages in [from, to) by topic, or by topic and mailing list if byList is set.
+func (db *DB) GetTopicStats(senderTGId int64, from, to time.Time, byList bool) ([]TopicStats, error) {
+	keys := "TopicId"
+	if byList {
+		keys = "TopicId, ListId"
+	}
+	joinOn := func(table string) string {
+		on := fmt.Sprintf("%s.TopicId = counts.TopicId", table)
+		if byList {
+			on += fmt.Sprintf(" AND %s.ListId = counts.ListId", table)
+		}
+		return on
+	}
+
+	counts := db.db.NewSelect().
+		TableExpr("statsMessage").
+		ColumnExpr(keys).
+		ColumnExpr("SUM(IsRecipientMessage = 0) AS Sent").
+		ColumnExpr("SUM(IsRecipientMessage = 1) AS Received").
+		ColumnExpr("SUM(MediaType != '') AS Media").
+		ColumnExpr("SUM(IsRecipientMessage = 0 AND Read = 1) AS Read").
+		ColumnExpr("SUM(IsRecipientMessage = 0 AND React != '') AS Reacted").
+		GroupExpr(keys)
+	// first message to every recipient
+	reached := db.db.NewSelect().
+		TableExpr("statsMessage").
+		ColumnExpr(keys).
+		ColumnExpr("RecipientTGId").
+		ColumnExpr("MIN(SentAt) AS FirstSentAt").
+		Where("IsRecipientMessage = 0").
+		GroupExpr(keys + ", RecipientTGId")
+	// days from it to the first reply, NULL if the recipient didn't reply
+	firstReply := "SELECT MIN(reply.SentAt) FROM statsMessage AS reply " +
+		"WHERE reply.IsRecipientMessage = 1 AND reply.TopicId = reached.TopicId AND reply.RecipientTGId = reached.RecipientTGId " +
+		"AND reply.SentAt >= reached.FirstSentAt"
+	if byList {
+		// replies keep the list of the message they answer
+		firstReply += " AND reply.ListId = reached.ListId"
+	}
+	delays := db.db.NewSelect().
+		TableExpr("reached").
+		ColumnExpr(keys).
+		ColumnExpr("(" + firstReply + ") - FirstSentAt AS Delay")
+	responses := db.db.NewSelect().
+		TableExpr("delays").
+		ColumnExpr(keys).
+		ColumnExpr("COUNT(*) AS Reached").
+		ColumnExpr("COUNT(Delay) AS Responded").
+		GroupExpr(keys)
+	ranked := db.db.NewSelect().
+		TableExpr("delays").
+		ColumnExpr(keys).
+		ColumnExpr("Delay").
+		ColumnExpr("ROW_NUMBER() OVER (PARTITION BY " + keys + " ORDER BY Delay) AS Position").
+		ColumnExpr("COUNT(*) OVER (PARTITION BY " + keys + ") AS Total").
+		Where("Delay IS NOT NULL")
+	// median is the middle delay, or the mean of two middle ones for even count
+	medians := db.db.NewSelect().
+		TableExpr("ranked").
+		ColumnExpr(keys).
+		ColumnExpr("AVG(Delay) * 86400 AS MedianReplySeconds").
+		Where("Position IN ((Total + 1) / 2, (Total + 2) / 2)").
+		GroupExpr(keys)
+
+	stats := make([]TopicStats, 0)
+	q := db.db.NewSelect().
+		With("statsMessage", db.statsMessagesQuery(senderTGId, from, to)).
+		With("counts", counts).
+		With("reached", reached).
+		With("delays", delays).
+		With("responses", responses).
+		With("ranked", ranked).
+		With("medians", medians).
+		Model(&stats).
+		ModelTableExpr("counts").
+		ColumnExpr("counts.*").
+		ColumnExpr("topic.Topic AS Topic").
+		ColumnExpr("COALESCE(responses.Reached, 0) AS Reached").
+		ColumnExpr("COALESCE(responses.Responded, 0) AS Responded").
+		ColumnExpr("medians.MedianReplySeconds AS MedianReplySeconds").
+		Join("JOIN Topics AS topic ON topic.TopicId = counts.TopicId").
+		Join("LEFT JOIN responses ON " + joinOn("responses")).
+		Join("LEFT JOIN medians ON " + joinOn("medians")).
+		OrderExpr("topic.Topic")
+	if byList {
+		q = q.ColumnExpr("COALESCE(mailingList.ListName, '') AS ListName").
+			Join("LEFT JOIN MailingList AS mailingList ON mailingList.ListId = counts.ListId").
+			OrderExpr("counts.ListId")
+	}
+	err := q.Scan(context.Background())
+	return stats, err
+}
+
+// GetTopicReactionCounts returns the number of every reaction by topic for sender's messages sent in [from, to).
+func (db *DB) GetTopicReactionCounts(senderTGId int64, from, to time.Time) (map[int64]map[string]int, error) {
+	var rows []struct {
+		TopicId int64  `bun:"TopicId"`
+		React   string `bun:"React"`
+		Count   int    `bun:"Count"`
+	}
 	err := db.db.NewSelect().
-		Model(&messages).
+		With("statsMessage", db.statsMessagesQuery(senderTGId, from, to)).
+		TableExpr("statsMessage").
+		ColumnExpr("TopicId, React").
+		ColumnExpr("COUNT(*) AS Count").
+		Where("IsRecipientMessage = 0 AND React != ''").
+		GroupExpr("TopicId, React").
+		Scan(context.Background(), &rows)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]map[string]int)
+	for _, row := range rows {
+		if counts[row.TopicId] == nil {
+			counts[row.TopicId] = make(map[string]int)
+		}
+		counts[row.TopicId][row.React] = row.Count
+	}
+	return counts, nil
+}
+
+type DailyActivity struct {
+	Day      string `bun:"Day"` // 2006-01-02
+	Sent     int    `bun:"Sent"`
+	Received int    `bun:"Received"`
+}
+
+// GetDailyActivity returns sender's messages sent in [from, to) by day, days without messages are skipped.
+func (db *DB) GetDailyActivity(senderTGId int64, from, to time.Time) ([]DailyActivity, error) {
+	activity := make([]DailyActivity, 0)
+	err := db.db.NewSelect().
+		With("statsMessage", db.statsMessagesQuery(senderTGId, from, to)).
+		TableExpr("statsMessage").
+		ColumnExpr("date(SentAt) AS Day").
+		ColumnExpr("SUM(IsRecipientMessage = 0) AS Sent").
+		ColumnExpr("SUM(IsRecipientMessage = 1) AS Received").
+		GroupExpr("Day").
+		OrderExpr("Day").
+		Scan(context.Background(), &activity)
+	return activity, err
+}
+
+// recipientMessagesQuery selects recipient replies within the topic, matching searchQuery if it's not empty.
+func (db *DB) recipientMessagesQuery(messages *[]models.Message, topicId int64, searchQuery string) *bun.SelectQuery {
+	q := db.db.NewSelect().
+		Model(messages).
 		Where("message.TopicId = (?)", topicId).
+		Where("message.IsRecipientMessage = (?)", 1)
+	if searchQuery != "" {
+		q = q.Join("JOIN MessagesFTS ON MessagesFTS.rowid = message.MessageId").
+			Where("MessagesFTS MATCH (?)", ftsQuery(searchQuery))
+	}
+	return q
+}
+
+func (db *DB) CountRecipientMessages(topicId int64, searchQuery string) (int, error) {
+	messages := make([]models.Message, 0)
+	return db.recipientMessagesQuery(&messages, topicId, searchQuery).Count(context.Background())
+}
+
+// GetRecipientMessagesPage returns recipient replies within the topic in order of arrival.
+func (db *DB) GetRecipientMessagesPage(topicId int64, searchQuery string, limit, offset int) ([]models.Message, error) {
+	messages := make([]models.Message, 0)
+	err := db.recipientMessagesQuery(&messages, topicId, searchQuery).
+		Order("message.MessageId").
+		Limit(limit).
+		Offset(offset).
 		Scan(context.Background())
 	return messages, err
 }
 
-func (db *DB) GetMessagesByTopicIdFromRecipient(topicId int64) ([]models.Message, error) {
+const (
+	// SnippetMatchStart and SnippetMatchEnd surround matched words in MessageSearchResult.Snippet
+	SnippetMatchStart = "\x02"
+	SnippetMatchEnd   = "\x03"
+)
+
+type MessageSearchResult struct {
+	models.Message
+
+	Topic   string `bun:"Topic"`
+	Snippet string `bun:"Snippet"`
+}
+
+// SearchRecipientMessages searches recipient replies across all sender's topics, best matches first.
+// It returns at most limit results and the total number of matches.
+func (db *DB) SearchRecipientMessages(senderTGId int64, searchQuery string, limit int) ([]MessageSearchResult, int, error) {
+	results := make([]MessageSearchResult, 0)
+	count, err := db.db.NewSelect().
+		Model(&results).
+		ModelTableExpr("Messages AS message").
+		ColumnExpr("message.*").
+		ColumnExpr("Topics.Topic AS Topic").
+		ColumnExpr("snippet(MessagesFTS, 0, ?, ?, '…', 12) AS Snippet", SnippetMatchStart, SnippetMatchEnd).
+		Join("JOIN MessagesFTS ON MessagesFTS.rowid = message.MessageId").
+		Join("JOIN Topics ON Topics.TopicId = message.TopicId").
+		Where("MessagesFTS MATCH (?)", ftsQuery(searchQuery)).
+		Where("Topics.SenderTGId = (?)", senderTGId).
+		Where("message.IsRecipientMessage = (?)", 1).
+		OrderExpr("MessagesFTS.rank").
+		Limit(limit).
+		ScanAndCount(context.Background())
+	return results, count, err
+}
+
+// ftsQuery turns user input into FTS5 query: every word is matched as a prefix, all words must be present.
+// Quoting keeps FTS5 syntax characters in user input from breaking the query.
+func ftsQuery(searchQuery string) string {
+	terms := make([]string, 0)
+	for _, word := range strings.Fields(searchQuery) {
+		word = strings.ReplaceAll(word, `"`, `""`)
+		terms = append(terms, `"`+word+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// GetTopicConversation returns messages in both directions between organization and the recipient within the topic,
+// oldest first.
+func (db *DB) GetTopicConversation(topicId int64, recipient models.Recipient) ([]models.Message, error) {
 	messages := make([]models.Message, 0)
 	err := db.db.NewSelect().
 		Model(&messages).
 		Where("message.TopicId = (?)", topicId).
-		Where("message.IsRecipientMessage = (?)", 1).
+		Apply(whereMessageRecipient(recipient.RecipientId)).
+		Order("message.SendDateTime", "message.MessageId").
 		Scan(context.Background())
 	return messages, err
 }
 
+// TopicExportRow is a topic message with the recipient it was sent to or received from.
+type TopicExportRow struct {
+	models.Message
+
+	// empty if the recipient is unknown
+	RecipientName   string `bun:"RecipientName"`
+	RecipientTGName string `bun:"RecipientTGName"`
+	RecipientTGId   int64  `bun:"RecipientTGId"`
+}
+
+// ExportTopicMessages calls fn for every topic message oldest first. Rows are scanned one by one,
+// so big topics aren't loaded into memory.
+func (db *DB) ExportTopicMessages(topicId int64, fn func(row TopicExportRow) error) error {
+	ctx := context.Background()
+	rows, err := db.db.NewSelect().
+		TableExpr("Messages AS message").
+		ColumnExpr("message.*").
+		ColumnExpr("COALESCE(recipient.RecipientName, '') AS RecipientName").
+		ColumnExpr("COALESCE(recipient.RecipientTGName, '') AS RecipientTGName").
+		ColumnExpr("COALESCE(recipient.RecipientTGId, 0) AS RecipientTGId").
+		Apply(joinMessageRecipient).
+		Where("message.TopicId = (?)", topicId).
+		OrderExpr("message.SendDateTime, message.MessageId").
+		Rows(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := TopicExportRow{}
+		err = db.db.ScanRow(ctx, rows, &row)
+		if err != nil {
+			return err
+		}
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetSentMessage returns message sent to the recipient's chat.
+func (db *DB) GetSentMessage(recipient models.Recipient, messageTGId int64) (models.Message, error) {
+	message := models.Message{}
+	err := db.db.NewSelect().
+		Model(&message).
+		Where("message.MessageTGId = (?)", messageTGId).
+		Where("message.IsRecipientMessage = (?)", 0).
+		Apply(whereMessageRecipient(recipient.RecipientId)).
+		Scan(context.Background())
+	return message, err
+}
+
+func (db *DB) MarkMessageRead(messageId int64) error {
+	_, err := db.db.NewUpdate().
+		Model((*models.Message)(nil)).
+		Set("Read = 1").
+		Where("MessageId = (?)", messageId).
+		Exec(context.Background())
+	return err
+}
+
+// SetMessageReact saves recipient's reaction, it also marks the message read.
+func (db *DB) SetMessageReact(messageId int64, react string) error {
+	_, err := db.db.NewUpdate().
+		Model((*models.Message)(nil)).
+		Set("React = (?)", react).
+		Set("Read = 1").
+		Where("MessageId = (?)", messageId).
+		Exec(context.Background())
+	return err
+}
+
 func (db *DB) GetMessageByMessageId(messageId int64) (models.Message, error) {
 	message := models.Message{}
 	err := db.db.NewSelect().
@@ -184,18 +680,1102 @@ func (db *DB) GetMessageByMessageId(messageId int64) (models.Message, error) {
 	return message, err
 }
 
-func (db *DB) SetNotificationsConfig(senderTGId int64, value bool) error {
-	db.notificationsConfigLock.Lock()
-	defer db.notificationsConfigLock.Unlock()
-	db.notificationsConfig[senderTGId] = value
+func (db *DB) GetSenderSettings(senderTGId int64) (models.SenderSettings, error) {
+	settings := models.SenderSettings{}
+	err := db.db.NewSelect().
+		Model(&settings).
+		Where("senderSettings.SenderTGId = (?)", senderTGId).
+		Scan(context.Background())
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.DefaultSenderSettings(senderTGId), nil
+	}
+	return settings, err
+}
 
-	return nil
+func (db *DB) SaveSenderSettings(settings models.SenderSettings) error {
+	_, err := db.db.NewInsert().
+		Model(&settings).
+		On("CONFLICT (SenderTGId) DO UPDATE").
+		Set("NotificationsEnabled = EXCLUDED.NotificationsEnabled").
+		Set("QuietHoursEnabled = EXCLUDED.QuietHoursEnabled").
+		Set("QuietHoursFrom = EXCLUDED.QuietHoursFrom").
+		Set("QuietHoursTo = EXCLUDED.QuietHoursTo").
+		Set("DigestMode = EXCLUDED.DigestMode").
+		Set("LastDigestMessageId = EXCLUDED.LastDigestMessageId").
+		Exec(context.Background())
+	return err
+}
+
+func (db *DB) GetDigestModeSenders() ([]models.SenderSettings, error) {
+	settings := make([]models.SenderSettings, 0)
+	err := db.db.NewSelect().
+		Model(&settings).
+		Where("senderSettings.DigestMode = (?)", true).
+		Scan(context.Background())
+	return settings, err
+}
+
+// GetRecipientMessagesAfter returns replies to sender's topics with MessageId greater than afterMessageId.
+func (db *DB) GetRecipientMessagesAfter(senderTGId, afterMessageId int64) ([]models.Message, error) {
+	messages := make([]models.Message, 0)
+	err := db.db.NewSelect().
+		Model(&messages).
+		Where("message.SenderTGId = (?)", senderTGId).
+		Where("message.IsRecipientMessage = (?)", 1).
+		Where("message.MessageId > (?)", afterMessageId).
+		Order("message.MessageId").
+		Scan(context.Background())
+	return messages, err
+}
+
+func (db *DB) SetNotificationsConfig(senderTGId int64, value bool) error {
+	settings, err := db.GetSenderSettings(senderTGId)
+	if err != nil {
+		return err
+	}
+	settings.NotificationsEnabled = value
+	return db.SaveSenderSettings(settings)
 }
 
 func (db *DB) GetNotificationsConfig(senderTGId int64) (bool, error) {
-	db.notificationsConfigLock.Lock()
-	defer db.notificationsConfigLock.Unlock()
-	value := db.notificationsConfig[senderTGId]
+	settings, err := db.GetSenderSettings(senderTGId)
+	return settings.NotificationsEnabled, err
+}
+
+func (db *DB) GetLastMessageId() (int64, error) {
+	var id int64
+	err := db.db.NewSelect().
+		Model((*models.Message)(nil)).
+		ColumnExpr("COALESCE(MAX(message.MessageId), 0)").
+		Scan(context.Background(), &id)
+	return id, err
+}
+
+func (db *DB) GetMailingListById(listId int64) (models.MailingList, error) {
+	mList := models.MailingList{}
+	err := db.db.NewSelect().
+		Model(&mList).
+		Where("mailingList.ListId = (?)", listId).
+		Scan(context.Background())
+	return mList, err
+}
+
+// GetConversation returns sql.ErrNoRows if chat has no active conversation.
+func (db *DB) GetConversation(chatId int64) (models.Conversation, error) {
+	conversation := models.Conversation{}
+	err := db.db.NewSelect().
+		Model(&conversation).
+		Where("conversation.ChatId = (?)", chatId).
+		Scan(context.Background())
+	return conversation, err
+}
+
+func (db *DB) SaveConversation(conversation models.Conversation) error {
+	_, err := db.db.NewInsert().
+		Model(&conversation).
+		On("CONFLICT (ChatId) DO UPDATE").
+		Set("State = EXCLUDED.State").
+		Set("Data = EXCLUDED.Data").
+		Set("UpdatedAt = EXCLUDED.UpdatedAt").
+		Exec(context.Background())
+	return err
+}
+
+func (db *DB) DeleteConversation(chatId int64) error {
+	_, err := db.db.NewDelete().
+		Model((*models.Conversation)(nil)).
+		Where("ChatId = (?)", chatId).
+		Exec(context.Background())
+	return err
+}
+
+func (db *DB) GetConversationsUpdatedBefore(t time.Time) ([]models.Conversation, error) {
+	conversations := make([]models.Conversation, 0)
+	err := db.db.NewSelect().
+		Model(&conversations).
+		Where("conversation.UpdatedAt < (?)", t).
+		Scan(context.Background())
+	return conversations, err
+}
+
+func (db *DB) AddJob(job models.Job) (models.Job, error) {
+	_, err := db.db.NewInsert().Model(&job).Exec(context.Background())
+	return job, err
+}
+
+func (db *DB) GetJobById(jobId int64) (models.Job, error) {
+	job := models.Job{}
+	err := db.db.NewSelect().
+		Model(&job).
+		Where("job.JobId = (?)", jobId).
+		Scan(context.Background())
+	return job, err
+}
+
+func (db *DB) GetPendingJobsBySender(senderTGId int64) ([]models.Job, error) {
+	jobs := make([]models.Job, 0)
+	err := db.db.NewSelect().
+		Model(&jobs).
+		Where("job.SenderTGId = (?)", senderTGId).
+		Where("job.Status = (?)", models.JobStatusPending).
+		Order("job.RunAt").
+		Scan(context.Background())
+	return jobs, err
+}
+
+func (db *DB) GetDueJobs(now time.Time) ([]models.Job, error) {
+	jobs := make([]models.Job, 0)
+	err := db.db.NewSelect().
+		Model(&jobs).
+		Where("job.Status = (?)", models.JobStatusPending).
+		Where("job.RunAt <= (?)", now).
+		Order("job.RunAt").
+		Scan(context.Background())
+	return jobs, err
+}
+
+func (db *DB) UpdateJob(job models.Job) error {
+	_, err := db.db.NewUpdate().
+		Model(&job).
+		WherePK().
+		Exec(context.Background())
+	return err
+}
+
+// AddBroadcast saves broadcast with a pending delivery for every active recipient, inactive ones are saved as skipped.
+func (db *DB) AddBroadcast(broadcast models.Broadcast, recipients []models.Recipient) (models.Broadcast, error) {
+	err := db.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(&broadcast).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if len(recipients) == 0 {
+			return nil
+		}
+
+		deliveries := make([]models.Delivery, len(recipients))
+		for i, recipient := range recipients {
+			deliveries[i] = models.Delivery{
+				BroadcastId:   broadcast.BroadcastId,
+				RecipientId:   recipient.RecipientId,
+				RecipientTGId: recipient.RecipientTGId,
+				Status:        models.DeliveryStatusPending,
+				UpdatedAt:     broadcast.CreatedAt,
+			}
+			if recipient.Inactive {
+				deliveries[i].Status = models.DeliveryStatusSkipped
+				deliveries[i].Error = recipient.InactiveReason
+			}
+		}
+		_, err = tx.NewInsert().Model(&deliveries).Exec(ctx)
+		return err
+	})
+	return broadcast, err
+}
+
+func (db *DB) GetRunningBroadcasts() ([]models.Broadcast, error) {
+	broadcasts := make([]models.Broadcast, 0)
+	err := db.db.NewSelect().
+		Model(&broadcasts).
+		Where("broadcast.Status = (?)", models.BroadcastStatusRunning).
+		Order("broadcast.BroadcastId").
+		Scan(context.Background())
+	return broadcasts, err
+}
+
+func (db *DB) SetBroadcastStatus(broadcastId int64, status string) error {
+	_, err := db.db.NewUpdate().
+		Model((*models.Broadcast)(nil)).
+		Set("Status = (?)", status).
+		Where("BroadcastId = (?)", broadcastId).
+		Exec(context.Background())
+	return err
+}
+
+func (db *DB) GetPendingDeliveries(broadcastId int64) ([]models.Delivery, error) {
+	deliveries := make([]models.Delivery, 0)
+	err := db.db.NewSelect().
+		Model(&deliveries).
+		Where("delivery.BroadcastId = (?)", broadcastId).
+		Where("delivery.Status = (?)", models.DeliveryStatusPending).
+		Scan(context.Background())
+	return deliveries, err
+}
+
+func (db *DB) UpdateDelivery(delivery models.Delivery) error {
+	_, err := db.db.NewUpdate().
+		Model(&delivery).
+		WherePK().
+		Exec(context.Background())
+	return err
+}
+
+// GetDeliveryStats returns number of deliveries by status.
+func (db *DB) GetDeliveryStats(broadcastId int64) (map[string]int, error) {
+	var rows []struct {
+		Status string `bun:"Status"`
+		Count  int    `bun:"Count"`
+	}
+	err := db.db.NewSelect().
+		Model((*models.Delivery)(nil)).
+		Column("delivery.Status").
+		ColumnExpr("COUNT(*) AS Count").
+		Where("delivery.BroadcastId = (?)", broadcastId).
+		Group("delivery.Status").
+		Scan(context.Background(), &rows)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]int, len(rows))
+	for _, row := range rows {
+		stats[row.Status] = row.Count
+	}
+	return stats, nil
+}
+
+func (db *DB) SetRecipientInactive(recipientId int64, reason string) error {
+	_, err := db.db.NewUpdate().
+		Model((*models.Recipient)(nil)).
+		Set("Inactive = (?)", true).
+		Set("InactiveReason = (?)", reason).
+		Where("RecipientId = (?)", recipientId).
+		Exec(context.Background())
+	return err
+}
+
+func (db *DB) SetRecipientActive(recipientId int64) error {
+	_, err := db.db.NewUpdate().
+		Model((*models.Recipient)(nil)).
+		Set("Inactive = (?)", false).
+		Set("InactiveReason = ''").
+		Where("RecipientId = (?)", recipientId).
+		Exec(context.Background())
+	return err
+}
+
+// GetInactiveRecipientsBySender returns inactive members of sender's mailing lists.
+func (db *DB) GetInactiveRecipientsBySender(senderTGId int64) ([]models.Recipient, error) {
+	recipients := make([]models.Recipient, 0)
+	listRecipientsIds := db.db.NewSelect().
+		Model((*models.MailingListRelations)(nil)).
+		Column("mailingListRelations.RecipientId").
+		Join("JOIN MailingList ON MailingList.ListId = mailingListRelations.ListId").
+		Where("MailingList.SenderTGId = (?)", senderTGId)
+	err := db.db.NewSelect().
+		Model(&recipients).
+		Where("recipient.RecipientId IN (?)", listRecipientsIds).
+		Where("recipient.Inactive = (?)", true).
+		Order("recipient.RecipientName").
+		Scan(context.Background())
+	return recipients, err
+}
+
+func (db *DB) SetRecipientUnsubscribed(recipientId int64, value bool) error {
+	_, err := db.db.NewUpdate().
+		Model((*models.Recipient)(nil)).
+		Set("Unsubscribed = (?)", value).
+		Where("RecipientId = (?)", recipientId).
+		Exec(context.Background())
+	return err
+}
 
-	return value, nil
+func (db *DB) AddOptOut(optOut models.OptOut) error {
+	_, err := db.db.NewInsert().
+		Model(&optOut).
+		On("CONFLICT DO NOTHING").
+		Exec(context.Background())
+	return err
+}
+
+// IsOptedOut reports whether recipient unsubscribed globally, from the sender or from the list.
+func (db *DB) IsOptedOut(recipientId, senderTGId, listId int64) (bool, error) {
+	unsubscribed, err := db.db.NewSelect().
+		Model((*models.Recipient)(nil)).
+		Where("recipient.RecipientId = (?)", recipientId).
+		Where("recipient.Unsubscribed = (?)", true).
+		Exists(context.Background())
+	if err != nil || unsubscribed {
+		return unsubscribed, err
+	}
+	return db.db.NewSelect().
+		Model((*models.OptOut)(nil)).
+		Where("optOut.RecipientId = (?)", recipientId).
+		Where("optOut.SenderTGId = (?)", senderTGId).
+		Where("optOut.ListId IN (0, ?)", listId).
+		Exists(context.Background())
+}
+
+type OptOutStats struct {
+	// FromSender recipients unsubscribed from all sender's lists
+	FromSender int `bun:"FromSender"`
+	// FromLists recipients unsubscribed from some of sender's lists
+	FromLists int `bun:"FromLists"`
+	// Global members of sender's lists that unsubscribed from all broadcasts with /stop
+	Global int `bun:"Global"`
+}
+
+func (db *DB) GetOptOutStatsBySender(senderTGId int64) (OptOutStats, error) {
+	stats := OptOutStats{}
+	err := db.db.NewSelect().
+		Model((*models.OptOut)(nil)).
+		ColumnExpr("COUNT(DISTINCT CASE WHEN optOut.ListId = 0 THEN optOut.RecipientId END) AS FromSender").
+		ColumnExpr("COUNT(DISTINCT CASE WHEN optOut.ListId != 0 THEN optOut.RecipientId END) AS FromLists").
+		Where("optOut.SenderTGId = (?)", senderTGId).
+		Scan(context.Background(), &stats)
+	if err != nil {
+		return stats, err
+	}
+
+	listRecipientsIds := db.db.NewSelect().
+		Model((*models.MailingListRelations)(nil)).
+		Column("mailingListRelations.RecipientId").
+		Join("JOIN MailingList ON MailingList.ListId = mailingListRelations.ListId").
+		Where("MailingList.SenderTGId = (?)", senderTGId)
+	stats.Global, err = db.db.NewSelect().
+		Model((*models.Recipient)(nil)).
+		Where("recipient.RecipientId IN (?)", listRecipientsIds).
+		Where("recipient.Unsubscribed = (?)", true).
+		Count(context.Background())
+	return stats, err
+}
+
+type MailingListWithCount struct {
+	models.MailingList
+
+	MembersCount int `bun:"MembersCount"`
+}
+
+func (db *DB) GetMailingListsWithCountsBySender(senderTGId int64) ([]MailingListWithCount, error) {
+	lists := make([]MailingListWithCount, 0)
+	err := db.db.NewSelect().
+		Model(&lists).
+		ModelTableExpr("MailingList AS mailingList").
+		ColumnExpr("mailingList.*").
+		ColumnExpr("COUNT(DISTINCT MailingListRelations.RecipientId) AS MembersCount").
+		Join("LEFT JOIN MailingListRelations ON mailingList.ListId = MailingListRelations.ListId").
+		Where("mailingList.SenderTGId = (?)", senderTGId).
+		Group("mailingList.ListId").
+		Order("mailingList.ListName").
+		Scan(context.Background())
+	return lists, err
+}
+
+func (db *DB) GetMailingListsByName(senderTGId int64, listName string) ([]models.MailingList, error) {
+	lists := make([]models.MailingList, 0)
+	err := db.db.NewSelect().
+		Model(&lists).
+		Where("mailingList.SenderTGId = (?)", senderTGId).
+		Where("mailingList.ListName = (?)", listName).
+		Scan(context.Background())
+	return lists, err
+}
+
+// GetMailingListMembers returns all list members including inactive and unsubscribed ones.
+func (db *DB) GetMailingListMembers(listId int64) ([]models.Recipient, error) {
+	recipients := make([]models.Recipient, 0)
+	membersIds := db.db.NewSelect().
+		Model((*models.MailingListRelations)(nil)).
+		Column("mailingListRelations.RecipientId").
+		Where("mailingListRelations.ListId = (?)", listId)
+	err := db.db.NewSelect().
+		Model(&recipients).
+		Where("recipient.RecipientId IN (?)", membersIds).
+		Order("recipient.RecipientTGName").
+		Scan(context.Background())
+	return recipients, err
+}
+
+// AddMailingListMembers adds recipients that aren't list members yet and returns how many were added.
+func (db *DB) AddMailingListMembers(listId int64, recipientsIds []int64) (int, error) {
+	existingIds := make([]int64, 0)
+	err := db.db.NewSelect().
+		Model((*models.MailingListRelations)(nil)).
+		Column("mailingListRelations.RecipientId").
+		Where("mailingListRelations.ListId = (?)", listId).
+		Scan(context.Background(), &existingIds)
+	if err != nil {
+		return 0, err
+	}
+	existing := make(map[int64]struct{}, len(existingIds))
+	for _, id := range existingIds {
+		existing[id] = struct{}{}
+	}
+
+	relations := make([]models.MailingListRelations, 0, len(recipientsIds))
+	for _, id := range recipientsIds {
+		if _, ok := existing[id]; ok {
+			continue
+		}
+		existing[id] = struct{}{}
+		relations = append(relations, models.MailingListRelations{ListId: listId, RecipientId: id})
+	}
+	if len(relations) == 0 {
+		return 0, nil
+	}
+	_, err = db.db.NewInsert().Model(&relations).Exec(context.Background())
+	return len(relations), err
+}
+
+// RemoveMailingListMembers returns how many members were removed.
+func (db *DB) RemoveMailingListMembers(listId int64, recipientsIds []int64) (int, error) {
+	res, err := db.db.NewDelete().
+		Model((*models.MailingListRelations)(nil)).
+		Where("ListId = (?)", listId).
+		Where("RecipientId IN (?)", bun.In(recipientsIds)).
+		Exec(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (db *DB) RenameMailingList(listId int64, listName string) error {
+	_, err := db.db.NewUpdate().
+		Model((*models.MailingList)(nil)).
+		Set("ListName = (?)", listName).
+		Where("ListId = (?)", listId).
+		Exec(context.Background())
+	return err
+}
+
+// DeleteMailingList deletes list with its members relations, opt-outs and invite links and cancels its pending jobs.
+// Sent messages are kept for history.
+func (db *DB) DeleteMailingList(listId int64) error {
+	return db.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().
+			Model((*models.MailingListRelations)(nil)).
+			Where("ListId = (?)", listId).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().
+			Model((*models.OptOut)(nil)).
+			Where("ListId = (?)", listId).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().
+			Model((*models.InviteLink)(nil)).
+			Where("ListId = (?)", listId).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().
+			Model((*models.InviteUse)(nil)).
+			Where("ListId = (?)", listId).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().
+			Model((*models.Job)(nil)).
+			Set("Status = (?)", models.JobStatusCancelled).
+			Where("ListId = (?)", listId).
+			Where("Status = (?)", models.JobStatusPending).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().
+			Model((*models.MailingList)(nil)).
+			Where("ListId = (?)", listId).
+			Exec(ctx)
+		return err
+	})
+}
+
+// DeleteOptOuts removes recipient's opt-outs from the list and from the whole sender.
+func (db *DB) DeleteOptOuts(recipientId, senderTGId, listId int64) error {
+	_, err := db.db.NewDelete().
+		Model((*models.OptOut)(nil)).
+		Where("RecipientId = (?)", recipientId).
+		Where("SenderTGId = (?)", senderTGId).
+		Where("ListId IN (0, ?)", listId).
+		Exec(context.Background())
+	return err
+}
+
+func (db *DB) AddInviteLink(link models.InviteLink) error {
+	_, err := db.db.NewInsert().Model(&link).Exec(context.Background())
+	return err
+}
+
+func (db *DB) GetInviteLinkByToken(token string) (models.InviteLink, error) {
+	link := models.InviteLink{}
+	err := db.db.NewSelect().
+		Model(&link).
+		Where("inviteLink.Token = (?)", token).
+		Scan(context.Background())
+	return link, err
+}
+
+// GetInviteLinkByList returns list's default link: without label, expiry and usage cap.
+func (db *DB) GetInviteLinkByList(listId int64) (models.InviteLink, error) {
+	link := models.InviteLink{}
+	err := db.db.NewSelect().
+		Model(&link).
+		Where("inviteLink.ListId = (?)", listId).
+		Where("inviteLink.Label = ''").
+		Where("inviteLink.ExpiresAt IS NULL").
+		Where("inviteLink.MaxUses = 0").
+		Where("inviteLink.Revoked = (?)", false).
+		Order("inviteLink.CreatedAt").
+		Limit(1).
+		Scan(context.Background())
+	return link, err
+}
+
+func (db *DB) RevokeInviteLink(token string) error {
+	_, err := db.db.NewUpdate().
+		Model((*models.InviteLink)(nil)).
+		Set("Revoked = (?)", true).
+		Where("Token = (?)", token).
+		Exec(context.Background())
+	return err
+}
+
+// ClaimInviteUse saves the use if the link has fewer than maxUses uses, 0 means no cap.
+// The count and the insert are one statement, so concurrent joins can't exceed the cap.
+// It returns false if the cap is reached or the recipient has already used the link.
+func (db *DB) ClaimInviteUse(use models.InviteUse, maxUses int64) (bool, error) {
+	res, err := db.db.ExecContext(context.Background(), `
+INSERT INTO "InviteUses" ("Token", "RecipientId", "ListId", "NewRecipient", "UsedAt")
+SELECT ?, ?, ?, ?, ?
+WHERE ? = 0 OR (SELECT count(*) FROM "InviteUses" WHERE "Token" = ?) < ?
+ON CONFLICT DO NOTHING`,
+		use.Token, use.RecipientId, use.ListId, use.NewRecipient, use.UsedAt,
+		maxUses, use.Token, maxUses)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (db *DB) IsInviteUsedBy(token string, recipientId int64) (bool, error) {
+	return db.db.NewSelect().
+		Model((*models.InviteUse)(nil)).
+		Where("inviteUse.Token = (?)", token).
+		Where("inviteUse.RecipientId = (?)", recipientId).
+		Exists(context.Background())
+}
+
+type InviteLinkWithUses struct {
+	models.InviteLink
+
+	Uses          int `bun:"Uses"`
+	NewRecipients int `bun:"NewRecipients"`
+}
+
+func (db *DB) GetInviteLinksWithUsesBySender(senderTGId int64) ([]InviteLinkWithUses, error) {
+	links := make([]InviteLinkWithUses, 0)
+	err := db.db.NewSelect().
+		Model(&links).
+		ModelTableExpr("InviteLinks AS inviteLink").
+		ColumnExpr("inviteLink.*").
+		ColumnExpr("COUNT(InviteUses.RecipientId) AS Uses").
+		ColumnExpr("COUNT(CASE WHEN InviteUses.NewRecipient THEN 1 END) AS NewRecipients").
+		Join("LEFT JOIN InviteUses ON inviteLink.Token = InviteUses.Token").
+		Where("inviteLink.SenderTGId = (?)", senderTGId).
+		Group("inviteLink.Token").
+		Order("inviteLink.ListId", "inviteLink.CreatedAt").
+		Scan(context.Background())
+	return links, err
+}
+
+// GetInviteUseRecipients returns recipients that joined by the link, newest first.
+func (db *DB) GetInviteUseRecipients(token string) ([]models.Recipient, error) {
+	recipients := make([]models.Recipient, 0)
+	err := db.db.NewSelect().
+		Model(&recipients).
+		Join("JOIN InviteUses ON InviteUses.RecipientId = recipient.RecipientId").
+		Where("InviteUses.Token = (?)", token).
+		Order("InviteUses.UsedAt DESC").
+		Scan(context.Background())
+	return recipients, err
+}
+
+// AddOrganization creates organization with its owner, OrgId of both is set to the new id.
+func (db *DB) AddOrganization(org models.Organization, owner models.OrgMember) (models.Organization, error) {
+	err := db.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(&org).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		owner.OrgId = org.OrgId
+		_, err = tx.NewInsert().Model(&owner).Exec(ctx)
+		return err
+	})
+	return org, err
+}
+
+func (db *DB) GetOrganizationById(orgId int64) (models.Organization, error) {
+	org := models.Organization{}
+	err := db.db.NewSelect().
+		Model(&org).
+		Where("organization.OrgId = (?)", orgId).
+		Scan(context.Background())
+	return org, err
+}
+
+// GetOrgMemberByUser returns membership of the user, sql.ErrNoRows if the user isn't a member of any organization.
+func (db *DB) GetOrgMemberByUser(userTGId int64) (models.OrgMember, error) {
+	member := models.OrgMember{}
+	err := db.db.NewSelect().
+		Model(&member).
+		Where("orgMember.UserTGId = (?)", userTGId).
+		Scan(context.Background())
+	return member, err
+}
+
+func (db *DB) GetOrgMembers(orgId int64) ([]models.OrgMember, error) {
+	members := make([]models.OrgMember, 0)
+	err := db.db.NewSelect().
+		Model(&members).
+		Where("orgMember.OrgId = (?)", orgId).
+		Order("orgMember.JoinedAt").
+		Scan(context.Background())
+	return members, err
+}
+
+// SetOrgMemberRole returns false if the member is the last owner and the role isn't owner, nothing is changed then.
+// The check is a part of the update, so owners demoting each other at the same time can't both succeed.
+func (db *DB) SetOrgMemberRole(orgId, userTGId int64, role string) (bool, error) {
+	res, err := db.db.NewUpdate().
+		Model((*models.OrgMember)(nil)).
+		Set("Role = (?)", role).
+		Where("OrgId = (?)", orgId).
+		Where("UserTGId = (?)", userTGId).
+		Where("(?) = (?) OR EXISTS (?)", role, models.OrgRoleOwner, otherOrgOwners(db.db, orgId, userTGId)).
+		Exec(context.Background())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteOrgMember returns false if the member is the last owner and others stay, nothing is changed then.
+// The last member deletes the organization with its invites, pending scheduled broadcasts are cancelled.
+func (db *DB) DeleteOrgMember(orgId, userTGId int64) (bool, error) {
+	deleted := false
+	err := db.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		otherMembers := tx.NewSelect().
+			Model((*models.OrgMember)(nil)).
+			Where("OrgId = (?)", orgId).
+			Where("UserTGId != (?)", userTGId)
+		res, err := tx.NewDelete().
+			Model((*models.OrgMember)(nil)).
+			Where("OrgId = (?)", orgId).
+			Where("UserTGId = (?)", userTGId).
+			Where("Role != (?) OR EXISTS (?) OR NOT EXISTS (?)", models.OrgRoleOwner, otherOrgOwners(tx, orgId, userTGId), otherMembers).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		deleted = true
+
+		left, err := tx.NewSelect().Model((*models.OrgMember)(nil)).Where("OrgId = (?)", orgId).Count(ctx)
+		if err != nil || left > 0 {
+			return err
+		}
+		return deleteOrganization(ctx, tx, orgId)
+	})
+	return deleted, err
+}
+
+func otherOrgOwners(db bun.IDB, orgId, userTGId int64) *bun.SelectQuery {
+	return db.NewSelect().
+		Model((*models.OrgMember)(nil)).
+		Where("OrgId = (?)", orgId).
+		Where("UserTGId != (?)", userTGId).
+		Where("Role = (?)", models.OrgRoleOwner)
+}
+
+func deleteOrganization(ctx context.Context, tx bun.Tx, orgId int64) error {
+	_, err := tx.NewDelete().
+		Model((*models.OrgInvite)(nil)).
+		Where("OrgId = (?)", orgId).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.NewUpdate().
+		Model((*models.Job)(nil)).
+		Set("Status = (?)", models.JobStatusCancelled).
+		Where("SenderTGId = (?)", orgId).
+		Where("Status = (?)", models.JobStatusPending).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.NewDelete().
+		Model((*models.Organization)(nil)).
+		Where("OrgId = (?)", orgId).
+		Exec(ctx)
+	return err
+}
+
+func (db *DB) AddOrgInvite(invite models.OrgInvite) error {
+	_, err := db.db.NewInsert().Model(&invite).Exec(context.Background())
+	return err
+}
+
+func (db *DB) GetOrgInviteByToken(token string) (models.OrgInvite, error) {
+	invite := models.OrgInvite{}
+	err := db.db.NewSelect().
+		Model(&invite).
+		Where("orgInvite.Token = (?)", token).
+		Scan(context.Background())
+	return invite, err
+}
+
+// UseOrgInvite marks invite as used and adds the member. It returns false if the invite has already been used.
+func (db *DB) UseOrgInvite(token string, member models.OrgMember) (bool, error) {
+	used := false
+	err := db.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewUpdate().
+			Model((*models.OrgInvite)(nil)).
+			Set("UsedBy = (?)", member.UserTGId).
+			Where("Token = (?)", token).
+			Where("UsedBy = 0").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		_, err = tx.NewInsert().Model(&member).Exec(ctx)
+		used = err == nil
+		return err
+	})
+	return used, err
+}
+
+func (db *DB) AddMessageCopy(messageCopy models.MessageCopy) error {
+	_, err := db.db.NewInsert().
+		Model(&messageCopy).
+		On("CONFLICT DO NOTHING").
+		Exec(context.Background())
+	return err
+}
+
+// GetMessageByCopy returns stored message by its copy in the chat.
+func (db *DB) GetMessageByCopy(chatId, messageTGId int64) (models.Message, error) {
+	message := models.Message{}
+	err := db.db.NewSelect().
+		Model(&message).
+		Join("JOIN MessageCopies ON MessageCopies.MessageId = message.MessageId").
+		Where("MessageCopies.ChatId = (?)", chatId).
+		Where("MessageCopies.MessageTGId = (?)", messageTGId).
+		Scan(context.Background())
+	return message, err
+}
+
+func (db *DB) SaveCallbackState(state models.CallbackState) error {
+	_, err := db.db.NewInsert().
+		Model(&state).
+		On("CONFLICT (Token) DO UPDATE").
+		Set("Data = EXCLUDED.Data").
+		Set("UpdatedAt = EXCLUDED.UpdatedAt").
+		Exec(context.Background())
+	return err
+}
+
+// GetCallbackState returns sql.ErrNoRows if the keyboard state is unknown.
+func (db *DB) GetCallbackState(token string) (models.CallbackState, error) {
+	state := models.CallbackState{}
+	err := db.db.NewSelect().
+		Model(&state).
+		Where("callbackState.Token = (?)", token).
+		Scan(context.Background())
+	return state, err
+}
+
+func (db *DB) DeleteCallbackStatesUpdatedBefore(t time.Time) (int, error) {
+	res, err := db.db.NewDelete().
+		Model((*models.CallbackState)(nil)).
+		Where("UpdatedAt < (?)", t).
+		Exec(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// SavePagedMessage remembers which stored message the chat message shows now.
+func (db *DB) SavePagedMessage(pagedMessage models.PagedMessage) error {
+	_, err := db.db.NewInsert().
+		Model(&pagedMessage).
+		On("CONFLICT (ChatId, MessageTGId) DO UPDATE").
+		Set("MessageId = EXCLUDED.MessageId").
+		Set("ShownAt = EXCLUDED.ShownAt").
+		Exec(context.Background())
+	return err
+}
+
+// GetMessageByPagedMessage returns stored message shown by the paging message in the chat.
+func (db *DB) GetMessageByPagedMessage(chatId, messageTGId int64) (models.Message, error) {
+	message := models.Message{}
+	err := db.db.NewSelect().
+		Model(&message).
+		Join("JOIN PagedMessages ON PagedMessages.MessageId = message.MessageId").
+		Where("PagedMessages.ChatId = (?)", chatId).
+		Where("PagedMessages.MessageTGId = (?)", messageTGId).
+		Scan(context.Background())
+	return message, err
+}
+
+func (db *DB) DeletePagedMessagesShownBefore(t time.Time) (int, error) {
+	res, err := db.db.NewDelete().
+		Model((*models.PagedMessage)(nil)).
+		Where("ShownAt < (?)", t).
+		Exec(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// GetBotState returns sql.ErrNoRows if the value was never saved.
+func (db *DB) GetBotState(key string) (int64, error) {
+	state := models.BotState{}
+	err := db.db.NewSelect().
+		Model(&state).
+		Where("botState.Key = (?)", key).
+		Scan(context.Background())
+	return state.Value, err
+}
+
+func (db *DB) SaveBotState(key string, value int64) error {
+	_, err := db.db.NewInsert().
+		Model(&models.BotState{Key: key, Value: value}).
+		On("CONFLICT (Key) DO UPDATE").
+		Set("Value = EXCLUDED.Value").
+		Exec(context.Background())
+	return err
+}
+
+func (db *DB) AddPoll(poll models.Poll) (models.Poll, error) {
+	_, err := db.db.NewInsert().Model(&poll).Exec(context.Background())
+	return poll, err
+}
+
+func (db *DB) GetPollById(pollId int64) (models.Poll, error) {
+	poll := models.Poll{}
+	err := db.db.NewSelect().
+		Model(&poll).
+		Where("poll.PollId = (?)", pollId).
+		Scan(context.Background())
+	return poll, err
+}
+
+func (db *DB) GetPollsByTopicId(topicId int64) ([]models.Poll, error) {
+	polls := make([]models.Poll, 0)
+	err := db.db.NewSelect().
+		Model(&polls).
+		Where("poll.TopicId = (?)", topicId).
+		Order("poll.PollId").
+		Scan(context.Background())
+	return polls, err
+}
+
+func (db *DB) AddPollMessage(message models.PollMessage) error {
+	_, err := db.db.NewInsert().Model(&message).Exec(context.Background())
+	return err
+}
+
+// GetPollMessage returns sql.ErrNoRows if the poll wasn't sent by the bot.
+func (db *DB) GetPollMessage(tgPollId string) (models.PollMessage, error) {
+	message := models.PollMessage{}
+	err := db.db.NewSelect().
+		Model(&message).
+		Where("pollMessage.TGPollId = (?)", tgPollId).
+		Scan(context.Background())
+	return message, err
+}
+
+// SavePollAnswer saves the recipient's vote replacing the previous one.
+func (db *DB) SavePollAnswer(answer models.PollAnswer) error {
+	_, err := db.db.NewInsert().
+		Model(&answer).
+		On("CONFLICT (PollId, RecipientId) DO UPDATE").
+		Set("Options = EXCLUDED.Options").
+		Set("AnsweredAt = EXCLUDED.AnsweredAt").
+		Exec(context.Background())
+	return err
+}
+
+func (db *DB) DeletePollAnswer(pollId, recipientId int64) error {
+	_, err := db.db.NewDelete().
+		Model((*models.PollAnswer)(nil)).
+		Where("PollId = (?)", pollId).
+		Where("RecipientId = (?)", recipientId).
+		Exec(context.Background())
+	return err
+}
+
+type PollResults struct {
+	// Delivered recipients got the poll
+	Delivered int
+	// Answered recipients voted and didn't retract the vote
+	Answered int
+	// Votes is the number of votes by option index, with multiple answers they add up to more than Answered
+	Votes map[int]int
+}
+
+func (db *DB) GetPollResults(pollId int64) (PollResults, error) {
+	ctx := context.Background()
+	results := PollResults{Votes: make(map[int]int)}
+	var err error
+	results.Delivered, err = db.db.NewSelect().
+		Model((*models.PollMessage)(nil)).
+		Where("pollMessage.PollId = (?)", pollId).
+		Count(ctx)
+	if err != nil {
+		return results, err
+	}
+	results.Answered, err = db.db.NewSelect().
+		Model((*models.PollAnswer)(nil)).
+		Where("pollAnswer.PollId = (?)", pollId).
+		Count(ctx)
+	if err != nil {
+		return results, err
+	}
+
+	var votes []struct {
+		Option int `bun:"Option"`
+		Votes  int `bun:"Votes"`
+	}
+	err = db.db.NewSelect().
+		TableExpr("PollAnswers AS pollAnswer, json_each(pollAnswer.Options) AS answerOption").
+		ColumnExpr("answerOption.value AS Option").
+		ColumnExpr("COUNT(*) AS Votes").
+		Where("pollAnswer.PollId = (?)", pollId).
+		GroupExpr("answerOption.value").
+		Scan(ctx, &votes)
+	if err != nil {
+		return results, err
+	}
+	for _, vote := range votes {
+		results.Votes[vote.Option] = vote.Votes
+	}
+	return results, nil
+}
+
+// PollAnswerRow is a recipient who got the poll with their vote, Options is empty if they didn't vote.
+type PollAnswerRow struct {
+	models.Recipient
+
+	Options    []int     `bun:"Options"`
+	AnsweredAt time.Time `bun:"AnsweredAt"`
+}
+
+func (db *DB) GetPollAnswerRows(pollId int64) ([]PollAnswerRow, error) {
+	rows := make([]PollAnswerRow, 0)
+	err := db.db.NewSelect().
+		Model(&rows).
+		ModelTableExpr("Recipients AS recipient").
+		ColumnExpr("recipient.*").
+		ColumnExpr("pollAnswer.Options AS Options").
+		ColumnExpr("pollAnswer.AnsweredAt AS AnsweredAt").
+		Join("JOIN PollMessages AS pollMessage ON pollMessage.RecipientId = recipient.RecipientId").
+		Join("LEFT JOIN PollAnswers AS pollAnswer ON pollAnswer.PollId = pollMessage.PollId AND pollAnswer.RecipientId = pollMessage.RecipientId").
+		Where("pollMessage.PollId = (?)", pollId).
+		OrderExpr("recipient.RecipientName").
+		Scan(context.Background())
+	return rows, err
+}
+
+// SaveRecipientFields adds fields or replaces their values.
+func (db *DB) SaveRecipientFields(fields []models.RecipientField) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	_, err := db.db.NewInsert().
+		Model(&fields).
+		On("CONFLICT (SenderTGId, RecipientId, Name) DO UPDATE").
+		Set("Value = EXCLUDED.Value").
+		Exec(context.Background())
+	return err
+}
+
+// GetRecipientFields returns sender's custom fields of the recipients by RecipientId.
+func (db *DB) GetRecipientFields(senderTGId int64, recipientsIds []int64) (map[int64]map[string]string, error) {
+	fields := make([]models.RecipientField, 0)
+	err := db.db.NewSelect().
+		Model(&fields).
+		Where("recipientField.SenderTGId = (?)", senderTGId).
+		Where("recipientField.RecipientId IN (?)", bun.In(recipientsIds)).
+		Scan(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	byRecipient := make(map[int64]map[string]string)
+	for _, field := range fields {
+		if byRecipient[field.RecipientId] == nil {
+			byRecipient[field.RecipientId] = make(map[string]string)
+		}
+		byRecipient[field.RecipientId][field.Name] = field.Value
+	}
+	return byRecipient, nil
+}
+
+// SaveTemplate adds the template or replaces text of sender's template with the same name.
+func (db *DB) SaveTemplate(template models.MessageTemplate) error {
+	_, err := db.db.NewInsert().
+		Model(&template).
+		On("CONFLICT (SenderTGId, Name) DO UPDATE").
+		Set("Text = EXCLUDED.Text").
+		Set("UpdatedAt = EXCLUDED.UpdatedAt").
+		Exec(context.Background())
+	return err
+}
+
+// GetTemplateByName returns sql.ErrNoRows if sender has no template with the name.
+func (db *DB) GetTemplateByName(senderTGId int64, name string) (models.MessageTemplate, error) {
+	template := models.MessageTemplate{}
+	err := db.db.NewSelect().
+		Model(&template).
+		Where("template.SenderTGId = (?)", senderTGId).
+		Where("template.Name = (?)", name).
+		Scan(context.Background())
+	return template, err
+}
+
+func (db *DB) GetTemplatesBySender(senderTGId int64) ([]models.MessageTemplate, error) {
+	templates := make([]models.MessageTemplate, 0)
+	err := db.db.NewSelect().
+		Model(&templates).
+		Where("template.SenderTGId = (?)", senderTGId).
+		Order("template.Name").
+		Scan(context.Background())
+	return templates, err
+}
+
+// DeleteTemplate returns false if sender has no template with the name.
+func (db *DB) DeleteTemplate(senderTGId int64, name string) (bool, error) {
+	res, err := db.db.NewDelete().
+		Model((*models.MessageTemplate)(nil)).
+		Where("SenderTGId = (?)", senderTGId).
+		Where("Name = (?)", name).
+		Exec(context.Background())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/migrate"
+)
+
+// Migrations are embedded from migrations/<14 digit version>_<name>.[tx.]{up,down}.sql.
+// Applied versions are recorded in the bun_migrations table.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+func newMigrator(db *bun.DB) (*migrate.Migrator, error) {
+	migrations := migrate.NewMigrations()
+	err := migrations.Discover(migrationsFS)
+	if err != nil {
+		return nil, fmt.Errorf("discover migrations: %v", err)
+	}
+
+	migrator := migrate.NewMigrator(db, migrations)
+	err = migrator.Init(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("init migrations tables: %v", err)
+	}
+	return migrator, nil
+}
+
+// Migrator runs schema migrations without starting the rest of the app.
+type Migrator struct {
+	db       *bun.DB
+	migrator *migrate.Migrator
+}
+
+func NewMigrator(path string) (*Migrator, error) {
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	migrator, err := newMigrator(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Migrator{db: db, migrator: migrator}, nil
+}
+
+// Status returns all known migrations, applied ones have non-zero GroupID.
+func (m *Migrator) Status() (migrate.MigrationSlice, error) {
+	return m.migrator.MigrationsWithStatus(context.Background())
+}
+
+// Up applies all pending migrations as one group.
+func (m *Migrator) Up() (*migrate.MigrationGroup, error) {
+	return m.migrator.Migrate(context.Background())
+}
+
+// Down rolls back the last applied migration only. Migrations applied together at start form one group,
+// so rolling back the whole group could drop every table of a fresh db.
+// It returns nil if no migrations are applied.
+func (m *Migrator) Down() (*migrate.Migration, error) {
+	ctx := context.Background()
+	err := m.migrator.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.migrator.Unlock(ctx) //nolint:errcheck
+
+	migrations, err := m.migrator.MigrationsWithStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied := migrations.Applied()
+	if len(applied) == 0 {
+		return nil, nil
+	}
+	migration := &applied[0]
+	if migration.Down != nil {
+		err = migration.Down(ctx, m.db)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", migration.Name, err)
+		}
+	}
+	err = m.migrator.MarkUnapplied(ctx, migration)
+	if err != nil {
+		return nil, err
+	}
+	return migration, nil
+}
+
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS topics_unique;
+DROP TABLE IF EXISTS "Topics";
+DROP TABLE IF EXISTS "Messages";
+DROP TABLE IF EXISTS "MailingListRelations";
+DROP TABLE IF EXISTS "MailingList";
+DROP TABLE IF EXISTS "Recipients";
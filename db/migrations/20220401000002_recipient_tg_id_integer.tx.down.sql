@@ -0,0 +1,16 @@
+CREATE TABLE "Recipients_old"
+(
+    "RecipientId"     INTEGER NOT NULL UNIQUE,
+    "RecipientName"   TEXT    NOT NULL,
+    "RecipientTGName" TEXT    NOT NULL UNIQUE,
+    "RecipientTGId"   TEXT    NOT NULL UNIQUE,
+    PRIMARY KEY ("RecipientId" AUTOINCREMENT)
+);
+
+INSERT INTO "Recipients_old" ("RecipientId", "RecipientName", "RecipientTGName", "RecipientTGId")
+SELECT "RecipientId", "RecipientName", "RecipientTGName", "RecipientTGId"
+FROM "Recipients";
+
+DROP TABLE "Recipients";
+
+ALTER TABLE "Recipients_old" RENAME TO "Recipients";
@@ -0,0 +1,16 @@
+CREATE TABLE "Recipients_new"
+(
+    "RecipientId"     INTEGER NOT NULL UNIQUE,
+    "RecipientName"   TEXT    NOT NULL,
+    "RecipientTGName" TEXT    NOT NULL UNIQUE,
+    "RecipientTGId"   INTEGER NOT NULL UNIQUE,
+    PRIMARY KEY ("RecipientId" AUTOINCREMENT)
+);
+
+INSERT INTO "Recipients_new" ("RecipientId", "RecipientName", "RecipientTGName", "RecipientTGId")
+SELECT "RecipientId", "RecipientName", "RecipientTGName", CAST("RecipientTGId" AS INTEGER)
+FROM "Recipients";
+
+DROP TABLE "Recipients";
+
+ALTER TABLE "Recipients_new" RENAME TO "Recipients";
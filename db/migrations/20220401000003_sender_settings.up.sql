@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS "SenderSettings"
+(
+    "SenderTGId"           INTEGER NOT NULL UNIQUE,
+    "NotificationsEnabled" INTEGER NOT NULL DEFAULT 0,
+    "QuietHoursEnabled"    INTEGER NOT NULL DEFAULT 0,
+    "QuietHoursFrom"       INTEGER NOT NULL DEFAULT 0,
+    "QuietHoursTo"         INTEGER NOT NULL DEFAULT 0,
+    "DigestMode"           INTEGER NOT NULL DEFAULT 0,
+    "LastDigestMessageId"  INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY ("SenderTGId")
+);
@@ -0,0 +1,3 @@
+ALTER TABLE "Messages" DROP COLUMN "FileId";
+--bun:split
+ALTER TABLE "Messages" DROP COLUMN "MediaType";
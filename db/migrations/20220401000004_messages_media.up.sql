@@ -0,0 +1,3 @@
+ALTER TABLE "Messages" ADD COLUMN "MediaType" TEXT NOT NULL DEFAULT '';
+--bun:split
+ALTER TABLE "Messages" ADD COLUMN "FileId" TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS "Conversations"
+(
+    "ChatId"    INTEGER NOT NULL UNIQUE,
+    "State"     TEXT    NOT NULL,
+    "Data"      TEXT    NOT NULL DEFAULT '',
+    "UpdatedAt" TEXT    NOT NULL,
+    PRIMARY KEY ("ChatId")
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS jobs_status_run_at;
+--bun:split
+DROP TABLE IF EXISTS "Jobs";
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS "Jobs"
+(
+    "JobId"       INTEGER NOT NULL UNIQUE,
+    "SenderTGId"  INTEGER NOT NULL,
+    "TopicId"     INTEGER NOT NULL,
+    "ListId"      INTEGER NOT NULL,
+    "Message"     TEXT    NOT NULL,
+    "MediaType"   TEXT    NOT NULL DEFAULT '',
+    "FileId"      TEXT    NOT NULL DEFAULT '',
+    "RunAt"       TEXT    NOT NULL,
+    "RepeatEvery" INTEGER NOT NULL DEFAULT 0,
+    "Status"      TEXT    NOT NULL,
+    PRIMARY KEY ("JobId" AUTOINCREMENT)
+);
+--bun:split
+CREATE INDEX IF NOT EXISTS jobs_status_run_at
+    on "Jobs" ("Status", "RunAt");
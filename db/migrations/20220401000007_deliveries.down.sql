@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS "Deliveries";
+--bun:split
+DROP TABLE IF EXISTS "Broadcasts";
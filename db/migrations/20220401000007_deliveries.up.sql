@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS "Broadcasts"
+(
+    "BroadcastId" INTEGER NOT NULL UNIQUE,
+    "SenderTGId"  INTEGER NOT NULL,
+    "TopicId"     INTEGER NOT NULL,
+    "ListId"      INTEGER NOT NULL,
+    "Message"     TEXT    NOT NULL,
+    "MediaType"   TEXT    NOT NULL DEFAULT '',
+    "FileId"      TEXT    NOT NULL DEFAULT '',
+    "Status"      TEXT    NOT NULL,
+    "CreatedAt"   TEXT    NOT NULL,
+    PRIMARY KEY ("BroadcastId" AUTOINCREMENT)
+);
+--bun:split
+CREATE TABLE IF NOT EXISTS "Deliveries"
+(
+    "BroadcastId"   INTEGER NOT NULL,
+    "RecipientId"   INTEGER NOT NULL,
+    "RecipientTGId" INTEGER NOT NULL,
+    "Status"        TEXT    NOT NULL,
+    "Error"         TEXT    NOT NULL DEFAULT '',
+    "Attempts"      INTEGER NOT NULL DEFAULT 0,
+    "MessageTGId"   INTEGER NOT NULL DEFAULT 0,
+    "UpdatedAt"     TEXT    NOT NULL,
+    PRIMARY KEY ("BroadcastId", "RecipientId")
+);
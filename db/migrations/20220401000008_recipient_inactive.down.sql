@@ -0,0 +1,3 @@
+ALTER TABLE "Recipients" DROP COLUMN "InactiveReason";
+--bun:split
+ALTER TABLE "Recipients" DROP COLUMN "Inactive";
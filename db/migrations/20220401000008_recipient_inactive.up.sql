@@ -0,0 +1,3 @@
+ALTER TABLE "Recipients" ADD COLUMN "Inactive" INTEGER NOT NULL DEFAULT 0;
+--bun:split
+ALTER TABLE "Recipients" ADD COLUMN "InactiveReason" TEXT NOT NULL DEFAULT '';
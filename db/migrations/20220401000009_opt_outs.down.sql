@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS "OptOuts";
+--bun:split
+ALTER TABLE "Recipients" DROP COLUMN "Unsubscribed";
@@ -0,0 +1,10 @@
+ALTER TABLE "Recipients" ADD COLUMN "Unsubscribed" INTEGER NOT NULL DEFAULT 0;
+--bun:split
+CREATE TABLE IF NOT EXISTS "OptOuts"
+(
+    "RecipientId" INTEGER NOT NULL,
+    "SenderTGId"  INTEGER NOT NULL,
+    "ListId"      INTEGER NOT NULL DEFAULT 0,
+    "CreatedAt"   TEXT    NOT NULL,
+    PRIMARY KEY ("RecipientId", "SenderTGId", "ListId")
+);
@@ -0,0 +1,33 @@
+DROP INDEX IF EXISTS invite_links_list_id;
+
+DROP TABLE IF EXISTS "InviteLinks";
+
+DROP INDEX IF EXISTS recipients_tg_name;
+
+CREATE TABLE "Recipients_old"
+(
+    "RecipientId"     INTEGER NOT NULL UNIQUE,
+    "RecipientName"   TEXT    NOT NULL,
+    "RecipientTGName" TEXT    NOT NULL UNIQUE,
+    "RecipientTGId"   INTEGER NOT NULL UNIQUE,
+    "Inactive"        INTEGER NOT NULL DEFAULT 0,
+    "InactiveReason"  TEXT    NOT NULL DEFAULT '',
+    "Unsubscribed"    INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY ("RecipientId" AUTOINCREMENT)
+);
+
+-- users without username don't fit into unique column, keep their telegram id instead
+INSERT INTO "Recipients_old" ("RecipientId", "RecipientName", "RecipientTGName", "RecipientTGId",
+                              "Inactive", "InactiveReason", "Unsubscribed")
+SELECT "RecipientId",
+       "RecipientName",
+       CASE WHEN "RecipientTGName" = '' THEN CAST("RecipientTGId" AS TEXT) ELSE "RecipientTGName" END,
+       "RecipientTGId",
+       "Inactive",
+       "InactiveReason",
+       "Unsubscribed"
+FROM "Recipients";
+
+DROP TABLE "Recipients";
+
+ALTER TABLE "Recipients_old" RENAME TO "Recipients";
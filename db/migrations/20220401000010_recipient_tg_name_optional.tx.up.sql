@@ -0,0 +1,36 @@
+CREATE TABLE "Recipients_new"
+(
+    "RecipientId"     INTEGER NOT NULL UNIQUE,
+    "RecipientName"   TEXT    NOT NULL,
+    "RecipientTGName" TEXT    NOT NULL,
+    "RecipientTGId"   INTEGER NOT NULL UNIQUE,
+    "Inactive"        INTEGER NOT NULL DEFAULT 0,
+    "InactiveReason"  TEXT    NOT NULL DEFAULT '',
+    "Unsubscribed"    INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY ("RecipientId" AUTOINCREMENT)
+);
+
+INSERT INTO "Recipients_new" ("RecipientId", "RecipientName", "RecipientTGName", "RecipientTGId",
+                              "Inactive", "InactiveReason", "Unsubscribed")
+SELECT "RecipientId", "RecipientName", "RecipientTGName", "RecipientTGId",
+       "Inactive", "InactiveReason", "Unsubscribed"
+FROM "Recipients";
+
+DROP TABLE "Recipients";
+
+ALTER TABLE "Recipients_new" RENAME TO "Recipients";
+
+-- users without username are stored with empty RecipientTGName, telegram usernames are case-insensitive
+CREATE UNIQUE INDEX recipients_tg_name
+    ON "Recipients" (lower("RecipientTGName")) WHERE "RecipientTGName" != '';
+
+CREATE TABLE IF NOT EXISTS "InviteLinks"
+(
+    "Token"      TEXT    NOT NULL PRIMARY KEY,
+    "ListId"     INTEGER NOT NULL,
+    "SenderTGId" INTEGER NOT NULL,
+    "CreatedAt"  TEXT    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS invite_links_list_id
+    ON "InviteLinks" ("ListId");
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS "InviteUses";
+--bun:split
+ALTER TABLE "InviteLinks" DROP COLUMN "Revoked";
+--bun:split
+ALTER TABLE "InviteLinks" DROP COLUMN "MaxUses";
+--bun:split
+ALTER TABLE "InviteLinks" DROP COLUMN "ExpiresAt";
+--bun:split
+ALTER TABLE "InviteLinks" DROP COLUMN "Label";
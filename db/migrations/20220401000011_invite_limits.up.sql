@@ -0,0 +1,17 @@
+ALTER TABLE "InviteLinks" ADD COLUMN "Label" TEXT NOT NULL DEFAULT '';
+--bun:split
+ALTER TABLE "InviteLinks" ADD COLUMN "ExpiresAt" TEXT;
+--bun:split
+ALTER TABLE "InviteLinks" ADD COLUMN "MaxUses" INTEGER NOT NULL DEFAULT 0;
+--bun:split
+ALTER TABLE "InviteLinks" ADD COLUMN "Revoked" INTEGER NOT NULL DEFAULT 0;
+--bun:split
+CREATE TABLE IF NOT EXISTS "InviteUses"
+(
+    "Token"        TEXT    NOT NULL,
+    "RecipientId"  INTEGER NOT NULL,
+    "ListId"       INTEGER NOT NULL,
+    "NewRecipient" INTEGER NOT NULL DEFAULT 0,
+    "UsedAt"       TEXT    NOT NULL,
+    PRIMARY KEY ("Token", "RecipientId")
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS recipient_usernames_username;
+--bun:split
+DROP TABLE IF EXISTS "RecipientUsernames";
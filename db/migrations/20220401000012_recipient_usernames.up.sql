@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS "RecipientUsernames"
+(
+    "RecipientId" INTEGER NOT NULL,
+    "Username"    TEXT    NOT NULL,
+    "ReplacedAt"  TEXT    NOT NULL,
+    PRIMARY KEY ("RecipientId", "Username")
+);
+--bun:split
+CREATE INDEX IF NOT EXISTS recipient_usernames_username
+    on "RecipientUsernames" ("Username");
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS "MessageCopies";
+--bun:split
+DROP TABLE IF EXISTS "OrgInvites";
+--bun:split
+DROP TABLE IF EXISTS "OrgMembers";
+--bun:split
+DROP TABLE IF EXISTS "Organizations";
@@ -0,0 +1,51 @@
+CREATE TABLE IF NOT EXISTS "Organizations"
+(
+    "OrgId"     INTEGER NOT NULL UNIQUE,
+    "Name"      TEXT    NOT NULL,
+    "CreatedAt" TEXT    NOT NULL,
+    PRIMARY KEY ("OrgId")
+);
+--bun:split
+CREATE TABLE IF NOT EXISTS "OrgMembers"
+(
+    "OrgId"    INTEGER NOT NULL,
+    "UserTGId" INTEGER NOT NULL UNIQUE,
+    "Role"     TEXT    NOT NULL,
+    "Name"     TEXT    NOT NULL DEFAULT '',
+    "Username" TEXT    NOT NULL DEFAULT '',
+    "JoinedAt" TEXT    NOT NULL,
+    PRIMARY KEY ("OrgId", "UserTGId")
+);
+--bun:split
+CREATE TABLE IF NOT EXISTS "OrgInvites"
+(
+    "Token"     TEXT    NOT NULL PRIMARY KEY,
+    "OrgId"     INTEGER NOT NULL,
+    "Role"      TEXT    NOT NULL,
+    "CreatedBy" INTEGER NOT NULL,
+    "CreatedAt" TEXT    NOT NULL,
+    "ExpiresAt" TEXT    NOT NULL,
+    "UsedBy"    INTEGER NOT NULL DEFAULT 0
+);
+--bun:split
+CREATE TABLE IF NOT EXISTS "MessageCopies"
+(
+    "ChatId"      INTEGER NOT NULL,
+    "MessageTGId" INTEGER NOT NULL,
+    "MessageId"   INTEGER NOT NULL,
+    PRIMARY KEY ("ChatId", "MessageTGId")
+);
+--bun:split
+-- every existing sender becomes the owner of an organization with OrgId equal to sender's telegram id,
+-- so their lists, topics and messages stay with them
+INSERT INTO "Organizations" ("OrgId", "Name", "CreatedAt")
+SELECT "SenderTGId", '', strftime('%Y-%m-%d %H:%M:%S+00:00', 'now')
+FROM (SELECT "SenderTGId" FROM "MailingList"
+      UNION
+      SELECT "SenderTGId" FROM "Topics"
+      UNION
+      SELECT "SenderTGId" FROM "SenderSettings");
+--bun:split
+INSERT INTO "OrgMembers" ("OrgId", "UserTGId", "Role", "JoinedAt")
+SELECT "OrgId", "OrgId", 'owner', "CreatedAt"
+FROM "Organizations";
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS "CallbackStates"
+(
+    "Token"     TEXT    NOT NULL PRIMARY KEY,
+    "ChatId"    INTEGER NOT NULL,
+    "Data"      TEXT    NOT NULL,
+    "UpdatedAt" TEXT    NOT NULL
+);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS "BotState";
+--bun:split
+DROP INDEX IF EXISTS paged_messages_shown_at;
+--bun:split
+DROP TABLE IF EXISTS "PagedMessages";
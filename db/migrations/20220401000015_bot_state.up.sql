@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS "PagedMessages"
+(
+    "ChatId"      INTEGER NOT NULL,
+    "MessageTGId" INTEGER NOT NULL,
+    "MessageId"   INTEGER NOT NULL,
+    "ShownAt"     TEXT    NOT NULL,
+    PRIMARY KEY ("ChatId", "MessageTGId")
+);
+--bun:split
+CREATE INDEX IF NOT EXISTS paged_messages_shown_at
+    on "PagedMessages" ("ShownAt");
+--bun:split
+CREATE TABLE IF NOT EXISTS "BotState"
+(
+    "Key"   TEXT    NOT NULL PRIMARY KEY,
+    "Value" INTEGER NOT NULL
+);
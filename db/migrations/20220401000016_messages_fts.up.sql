@@ -0,0 +1,26 @@
+-- external content table over Messages, kept in sync by triggers
+CREATE VIRTUAL TABLE IF NOT EXISTS "MessagesFTS" USING fts5
+(
+    "Message",
+    content = 'Messages',
+    content_rowid = 'MessageId',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+--bun:split
+INSERT INTO "MessagesFTS" ("MessagesFTS") VALUES ('rebuild');
+--bun:split
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON "Messages"
+BEGIN
+    INSERT INTO "MessagesFTS" (rowid, "Message") VALUES (new."MessageId", new."Message");
+END;
+--bun:split
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON "Messages"
+BEGIN
+    INSERT INTO "MessagesFTS" ("MessagesFTS", rowid, "Message") VALUES ('delete', old."MessageId", old."Message");
+END;
+--bun:split
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF "Message" ON "Messages"
+BEGIN
+    INSERT INTO "MessagesFTS" ("MessagesFTS", rowid, "Message") VALUES ('delete', old."MessageId", old."Message");
+    INSERT INTO "MessagesFTS" (rowid, "Message") VALUES (new."MessageId", new."Message");
+END;
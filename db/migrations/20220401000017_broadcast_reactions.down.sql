@@ -0,0 +1 @@
+ALTER TABLE "Broadcasts" DROP COLUMN "Reactions";
@@ -0,0 +1 @@
+ALTER TABLE "Broadcasts" ADD COLUMN "Reactions" INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+ALTER TABLE "Broadcasts" DROP COLUMN "PollId";
+--bun:split
+DROP TABLE IF EXISTS "PollAnswers";
+--bun:split
+DROP TABLE IF EXISTS "PollMessages";
+--bun:split
+DROP TABLE IF EXISTS "Polls";
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS "Polls"
+(
+    "PollId"          INTEGER NOT NULL UNIQUE,
+    "SenderTGId"      INTEGER NOT NULL,
+    "TopicId"         INTEGER NOT NULL,
+    "ListId"          INTEGER NOT NULL,
+    "Question"        TEXT    NOT NULL,
+    "Options"         TEXT    NOT NULL,
+    "Quiz"            INTEGER NOT NULL DEFAULT 0,
+    "CorrectOption"   INTEGER NOT NULL DEFAULT 0,
+    "MultipleAnswers" INTEGER NOT NULL DEFAULT 0,
+    "CreatedAt"       TEXT    NOT NULL,
+    PRIMARY KEY ("PollId" AUTOINCREMENT)
+);
+--bun:split
+CREATE TABLE IF NOT EXISTS "PollMessages"
+(
+    "TGPollId"    TEXT    NOT NULL PRIMARY KEY,
+    "PollId"      INTEGER NOT NULL,
+    "RecipientId" INTEGER NOT NULL,
+    "MessageTGId" INTEGER NOT NULL
+);
+--bun:split
+CREATE TABLE IF NOT EXISTS "PollAnswers"
+(
+    "PollId"      INTEGER NOT NULL,
+    "RecipientId" INTEGER NOT NULL,
+    "Options"     TEXT    NOT NULL,
+    "AnsweredAt"  TEXT    NOT NULL,
+    PRIMARY KEY ("PollId", "RecipientId")
+);
+--bun:split
+ALTER TABLE "Broadcasts" ADD COLUMN "PollId" INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+ALTER TABLE "Broadcasts" DROP COLUMN "Template";
+--bun:split
+DROP TABLE IF EXISTS "Templates";
+--bun:split
+DROP TABLE IF EXISTS "RecipientFields";
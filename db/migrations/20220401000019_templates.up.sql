@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS "RecipientFields"
+(
+    "SenderTGId"  INTEGER NOT NULL,
+    "RecipientId" INTEGER NOT NULL,
+    "Name"        TEXT    NOT NULL,
+    "Value"       TEXT    NOT NULL,
+    PRIMARY KEY ("SenderTGId", "RecipientId", "Name")
+);
+--bun:split
+CREATE TABLE IF NOT EXISTS "Templates"
+(
+    "TemplateId" INTEGER NOT NULL UNIQUE,
+    "SenderTGId" INTEGER NOT NULL,
+    "Name"       TEXT    NOT NULL,
+    "Text"       TEXT    NOT NULL,
+    "UpdatedAt"  TEXT    NOT NULL,
+    PRIMARY KEY ("TemplateId" AUTOINCREMENT),
+    UNIQUE ("SenderTGId", "Name")
+);
+--bun:split
+ALTER TABLE "Broadcasts" ADD COLUMN "Template" INTEGER NOT NULL DEFAULT 0;
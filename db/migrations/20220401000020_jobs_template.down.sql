@@ -0,0 +1 @@
+ALTER TABLE "Jobs" DROP COLUMN "Template";
@@ -0,0 +1 @@
+ALTER TABLE "Jobs" ADD COLUMN "Template" INTEGER NOT NULL DEFAULT 0;
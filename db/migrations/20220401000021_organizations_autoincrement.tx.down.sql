@@ -0,0 +1,15 @@
+CREATE TABLE "Organizations_old"
+(
+    "OrgId"     INTEGER NOT NULL UNIQUE,
+    "Name"      TEXT    NOT NULL,
+    "CreatedAt" TEXT    NOT NULL,
+    PRIMARY KEY ("OrgId")
+);
+
+INSERT INTO "Organizations_old" ("OrgId", "Name", "CreatedAt")
+SELECT "OrgId", "Name", "CreatedAt"
+FROM "Organizations";
+
+DROP TABLE "Organizations";
+
+ALTER TABLE "Organizations_old" RENAME TO "Organizations";
@@ -0,0 +1,16 @@
+-- organizations are deleted when the last member leaves, their ids must not be given to new ones
+CREATE TABLE "Organizations_new"
+(
+    "OrgId"     INTEGER NOT NULL UNIQUE,
+    "Name"      TEXT    NOT NULL,
+    "CreatedAt" TEXT    NOT NULL,
+    PRIMARY KEY ("OrgId" AUTOINCREMENT)
+);
+
+INSERT INTO "Organizations_new" ("OrgId", "Name", "CreatedAt")
+SELECT "OrgId", "Name", "CreatedAt"
+FROM "Organizations";
+
+DROP TABLE "Organizations";
+
+ALTER TABLE "Organizations_new" RENAME TO "Organizations";
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"gopkg.in/telebot.v3"
+)
+
+const (
+	// telegram allows about 30 messages per second overall and 1 message per second to the same chat
+	globalSendRate       = 25
+	perChatSendInterval  = time.Second
+	maxDeliveryAttempts  = 5
+	deliveryPollInterval = 5 * time.Second
+)
+
+// broadcast saves broadcast with pending deliveries to every list member, they are sent by runDeliveries.
+// Text is rendered for every recipient only if content.Template is set, otherwise "{{" is sent as is.
+// reactions attaches reaction buttons to delivered messages, only the /broadcast wizard offers them.
+func (b *Bot) broadcast(senderTGId int64, topic models.Topic, mailingListId int64, content MessageContent, reactions bool) (models.Broadcast, error) {
+	return b.queueBroadcast(models.Broadcast{
+		SenderTGId: senderTGId,
+		TopicId:    topic.TopicId,
+		ListId:     mailingListId,
+		Message:    content.Text,
+		MediaType:  content.MediaType,
+		FileId:     content.FileId,
+		Reactions:  reactions,
+		Template:   content.Template,
+	})
+}
+
+// broadcastPoll saves the poll and queues it for delivery like broadcast, every recipient gets their own copy.
+func (b *Bot) broadcastPoll(poll models.Poll) (models.Broadcast, error) {
+	poll, err := b.db.AddPoll(poll)
+	if err != nil {
+		return models.Broadcast{}, fmt.Errorf("save poll: %v", err)
+	}
+	return b.queueBroadcast(models.Broadcast{
+		SenderTGId: poll.SenderTGId,
+		TopicId:    poll.TopicId,
+		ListId:     poll.ListId,
+		Message:    poll.Question,
+		MediaType:  models.MessageMediaPoll,
+		PollId:     poll.PollId,
+	})
+}
+
+// queueBroadcast returns *templateError if the template can't be rendered for some recipients, nothing is queued then.
+func (b *Bot) queueBroadcast(broadcast models.Broadcast) (models.Broadcast, error) {
+	recipients, err := b.db.GetMailingListRecipientsById(broadcast.ListId)
+	if err != nil {
+		return models.Broadcast{}, fmt.Errorf("load recipients: %v", err)
+	}
+	if broadcast.Template {
+		err = b.checkTemplate(broadcast.SenderTGId, broadcast.Message, broadcast.MediaType != "", recipients)
+		if err != nil {
+			return models.Broadcast{}, err
+		}
+	}
+
+	broadcast.Status = models.BroadcastStatusRunning
+	broadcast.CreatedAt = time.Now()
+	broadcast, err = b.db.AddBroadcast(broadcast, recipients)
+	if err != nil {
+		return models.Broadcast{}, fmt.Errorf("save broadcast: %v", err)
+	}
+
+	select {
+	case b.deliveryWakeCh <- struct{}{}:
+	default:
+	}
+	return broadcast, nil
+}
+
+// runDeliveries sends pending deliveries of running broadcasts, including ones left unfinished before restart.
+func (b *Bot) runDeliveries() {
+	defer b.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-b.stopCh
+		cancel()
+	}()
+
+	ticker := time.NewTicker(deliveryPollInterval)
+	defer ticker.Stop()
+	limiter := rate.NewLimiter(globalSendRate, 1)
+	lastSentToChat := make(map[int64]time.Time)
+
+	for {
+		broadcasts, err := b.db.GetRunningBroadcasts()
+		if err != nil {
+			log.Errorf("deliveries: load broadcasts: %v", err)
+		}
+		for _, broadcast := range broadcasts {
+			err = b.deliverBroadcast(ctx, broadcast, limiter, lastSentToChat)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Errorf("deliveries: broadcast #%d: %v", broadcast.BroadcastId, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.deliveryWakeCh:
+		}
+	}
+}
+
+func (b *Bot) deliverBroadcast(ctx context.Context, broadcast models.Broadcast, limiter *rate.Limiter, lastSentToChat map[int64]time.Time) error {
+	deliveries, err := b.db.GetPendingDeliveries(broadcast.BroadcastId)
+	if err != nil {
+		return err
+	}
+	content := broadcastContent{MessageContent: MessageContent{MediaType: broadcast.MediaType, FileId: broadcast.FileId, Text: broadcast.Message}}
+	if broadcast.PollId != 0 {
+		storedPoll, err := b.db.GetPollById(broadcast.PollId)
+		if err != nil {
+			return fmt.Errorf("load poll: %v", err)
+		}
+		content.Poll = telegramPoll(storedPoll)
+	}
+	if broadcast.Template {
+		content.Template, err = parseMessageTemplate(broadcast.Message)
+		if err != nil {
+			return fmt.Errorf("parse template: %v", err)
+		}
+	}
+
+	for _, delivery := range deliveries {
+		err = b.deliver(ctx, broadcast, content, delivery, limiter, lastSentToChat)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = b.db.SetBroadcastStatus(broadcast.BroadcastId, models.BroadcastStatusDone)
+	if err != nil {
+		return err
+	}
+	return b.sendDeliveryReport(broadcast)
+}
+
+// broadcastContent is what deliver sends: the message, or the poll instead of it for poll broadcasts.
+type broadcastContent struct {
+	MessageContent
+	Poll *telebot.Poll
+	// Template renders the message text for every recipient
+	Template *template.Template
+}
+
+// deliver sends content to the recipient of delivery.
+func (b *Bot) deliver(ctx context.Context, broadcast models.Broadcast, content broadcastContent, delivery models.Delivery,
+	limiter *rate.Limiter, lastSentToChat map[int64]time.Time) error {
+	optedOut, err := b.db.IsOptedOut(delivery.RecipientId, broadcast.SenderTGId, broadcast.ListId)
+	if err != nil {
+		return err
+	}
+	if optedOut {
+		delivery.Status = models.DeliveryStatusUnsubscribed
+		delivery.UpdatedAt = time.Now()
+		return b.db.UpdateDelivery(delivery)
+	}
+	if content.Template != nil {
+		// recipient's fields could change since the broadcast was queued, retrying won't help then
+		content.Text, err = b.renderForRecipient(content.Template, broadcast.SenderTGId, delivery.RecipientTGId, content.MediaType != "")
+		if err != nil {
+			delivery.Status = models.DeliveryStatusFailed
+			delivery.Error = fmt.Sprintf("render template: %v", err)
+			delivery.UpdatedAt = time.Now()
+			return b.db.UpdateDelivery(delivery)
+		}
+	}
+
+	for {
+		err := limiter.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		if wait := perChatSendInterval - time.Since(lastSentToChat[delivery.RecipientTGId]); wait > 0 {
+			err = sleepCtx(ctx, wait)
+			if err != nil {
+				return err
+			}
+		}
+
+		delivery.Attempts++
+		var message *telebot.Message
+		if content.Poll != nil {
+			message, err = b.client.Send(telebot.ChatID(delivery.RecipientTGId), content.Poll, broadcastMarkup(broadcast.ListId, false, ""))
+		} else {
+			message, err = b.sendContent(telebot.ChatID(delivery.RecipientTGId), content.MessageContent, broadcastMarkup(broadcast.ListId, broadcast.Reactions, ""))
+		}
+		lastSentToChat[delivery.RecipientTGId] = time.Now()
+		delivery.UpdatedAt = time.Now()
+		if err == nil {
+			delivery.Status = models.DeliveryStatusSent
+			delivery.Error = ""
+			delivery.MessageTGId = int64(message.ID)
+			_, err = b.db.AddMessage(models.Message{
+				MessageTGId:        int64(message.ID),
+				SenderTGId:         broadcast.SenderTGId,
+				RecipientId:        delivery.RecipientId,
+				TopicId:            broadcast.TopicId,
+				ListId:             broadcast.ListId,
+				SendDateTime:       message.Time(),
+				Message:            content.Text,
+				MediaType:          content.MediaType,
+				FileId:             content.FileId,
+				React:              "",
+				Read:               0,
+				IsRecipientMessage: 0,
+			})
+			if err != nil {
+				log.Errorf("save message: %v", err)
+			}
+			if message.Poll != nil {
+				err = b.db.AddPollMessage(models.PollMessage{
+					TGPollId:    message.Poll.ID,
+					PollId:      broadcast.PollId,
+					RecipientId: delivery.RecipientId,
+					MessageTGId: int64(message.ID),
+				})
+				if err != nil {
+					log.Errorf("save poll message: %v", err)
+				}
+			}
+			return b.db.UpdateDelivery(delivery)
+		}
+
+		var floodErr telebot.FloodError
+		switch {
+		case errors.As(err, &floodErr) && delivery.Attempts < maxDeliveryAttempts:
+			log.Warnf("deliveries: flood limit, retry after %ds", floodErr.RetryAfter)
+			err = sleepCtx(ctx, time.Duration(floodErr.RetryAfter)*time.Second)
+			if err != nil {
+				return err
+			}
+			continue
+		case isTransientSendError(err) && delivery.Attempts < maxDeliveryAttempts:
+			err = sleepCtx(ctx, time.Duration(delivery.Attempts)*time.Second)
+			if err != nil {
+				return err
+			}
+			continue
+		case recipientInactiveReason(err) != "":
+			delivery.Status = models.DeliveryStatusBlocked
+			dbErr := b.db.SetRecipientInactive(delivery.RecipientId, recipientInactiveReason(err))
+			if dbErr != nil {
+				log.Errorf("deliveries: deactivate recipient %d: %v", delivery.RecipientId, dbErr)
+			}
+		default:
+			delivery.Status = models.DeliveryStatusFailed
+		}
+		delivery.Error = err.Error()
+		return b.db.UpdateDelivery(delivery)
+	}
+}
+
+func (b *Bot) sendDeliveryReport(broadcast models.Broadcast) error {
+	stats, err := b.db.GetDeliveryStats(broadcast.BroadcastId)
+	if err != nil {
+		return err
+	}
+	topic, err := b.db.GetUserTopicById(broadcast.TopicId)
+	if err != nil {
+		return err
+	}
+
+	str := fmt.Sprintf("Рассылка #%d по топику '%s' завершена.\nДоставлено: %d\nОшибок: %d\nЗаблокировали бота: %d\nПропущено неактивных: %d\nОтписались до доставки: %d",
+		broadcast.BroadcastId, topic.Topic,
+		stats[models.DeliveryStatusSent], stats[models.DeliveryStatusFailed],
+		stats[models.DeliveryStatusBlocked], stats[models.DeliveryStatusSkipped], stats[models.DeliveryStatusUnsubscribed])
+	if stats[models.DeliveryStatusBlocked]+stats[models.DeliveryStatusSkipped] > 0 {
+		str += "\n\nСписок неактивных получателей: /inactive"
+	}
+	b.notifyOrganization(broadcast.SenderTGId, str)
+	return nil
+}
+
+// recipientInactiveReason returns models.RecipientInactive* reason if error means that
+// the recipient can't receive messages anymore, otherwise empty string.
+func recipientInactiveReason(err error) string {
+	switch {
+	case errors.Is(err, telebot.ErrBlockedByUser), errors.Is(err, telebot.ErrNotStartedByUser):
+		return models.RecipientInactiveBlocked
+	case errors.Is(err, telebot.ErrUserIsDeactivated):
+		return models.RecipientInactiveDeactivated
+	case errors.Is(err, telebot.ErrChatNotFound):
+		return models.RecipientInactiveNotFound
+	default:
+		return ""
+	}
+}
+
+// telebot v3 returns api errors it doesn't know as plain "telegram: <description> (<code>)"
+var unknownAPIErrorCode = regexp.MustCompile(`^telegram: .* \((\d+)\)$`)
+
+// isTransientSendError reports whether sending may succeed on retry: network errors and telegram server errors.
+// Other api errors, e.g. too long message or invalid file id, fail the same way every time.
+func isTransientSendError(err error) bool {
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) {
+		return true
+	}
+	var apiErr *telebot.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= 500
+	}
+	if match := unknownAPIErrorCode.FindStringSubmatch(err.Error()); match != nil {
+		code, _ := strconv.Atoi(match[1])
+		return code >= 500
+	}
+	return false
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+var btnReact = &telebot.Btn{Unique: "react"}
+
+var reactionButtons = []struct {
+	React string
+	Text  string
+}{
+	{models.ReactUp, "👍"},
+	{models.ReactDown, "👎"},
+	{models.ReactOk, "Понятно"},
+}
+
+func (b *Bot) initEngagementHandlers() {
+	b.client.Handle(btnReact, b.handleReactButton)
+}
+
+// broadcastMarkup is attached to every broadcast message, react marks the reaction chosen by the recipient.
+func broadcastMarkup(listId int64, reactions bool, react string) *telebot.ReplyMarkup {
+	var replyMarkup = &telebot.ReplyMarkup{}
+	var rows []telebot.Row
+	if reactions {
+		var buttons []telebot.Btn
+		for _, button := range reactionButtons {
+			text := button.Text
+			if button.React == react {
+				text = "✓ " + text
+			}
+			buttons = append(buttons, replyMarkup.Data(text, btnReact.Unique, button.React))
+		}
+		rows = append(rows, replyMarkup.Row(buttons...))
+	}
+	rows = append(rows, replyMarkup.Row(replyMarkup.Data("Отписаться", btnUnsubscribe.Unique, strconv.FormatInt(listId, 10))))
+	replyMarkup.Inline(rows...)
+	return replyMarkup
+}
+
+// callback data: <react>
+func (b *Bot) handleReactButton(ctx telebot.Context) error {
+	react := ctx.Callback().Data
+	if !isReact(react) {
+		return b.handleExpiredCallback(ctx)
+	}
+	message, ok, err := b.callbackSentMessage(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return b.handleExpiredCallback(ctx)
+	}
+	if message.React != react {
+		err = b.db.SetMessageReact(message.MessageId, react)
+		if err != nil {
+			log.Errorf("save reaction: %v", err)
+			return err
+		}
+		_, err = b.client.EditReplyMarkup(ctx.Message(), broadcastMarkup(message.ListId, true, react))
+		if err != nil && !isNotModified(err) {
+			log.Warnf("mark chosen reaction: %v", err)
+		}
+	}
+	return ctx.Respond(&telebot.CallbackResponse{Text: "Спасибо, ответ учтен"})
+}
+
+// markCallbackMessageRead marks broadcast message read when the recipient presses any of its buttons.
+func (b *Bot) markCallbackMessageRead(ctx telebot.Context) {
+	message, ok, err := b.callbackSentMessage(ctx)
+	if err == nil && ok && message.Read == 0 {
+		err = b.db.MarkMessageRead(message.MessageId)
+	}
+	if err != nil {
+		log.Errorf("mark message read: %v", err)
+	}
+}
+
+// callbackSentMessage returns stored message with the pressed button, ok is false for unknown messages.
+func (b *Bot) callbackSentMessage(ctx telebot.Context) (models.Message, bool, error) {
+	if ctx.Message() == nil {
+		return models.Message{}, false, nil
+	}
+	message, err := b.sentMessage(ctx.Sender().ID, ctx.Message().ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Message{}, false, nil
+	}
+	if err != nil {
+		return models.Message{}, false, err
+	}
+	return message, true, nil
+}
+
+// sentMessage returns stored message sent to the recipient's chat,
+// sql.ErrNoRows if the user isn't a recipient or the message is unknown.
+func (b *Bot) sentMessage(userTGId int64, messageTGId int) (models.Message, error) {
+	recipients, err := b.db.GetRecipientsByIds([]int64{userTGId})
+	if err != nil {
+		return models.Message{}, err
+	}
+	if len(recipients) == 0 {
+		return models.Message{}, sql.ErrNoRows
+	}
+	return b.db.GetSentMessage(recipients[0], int64(messageTGId))
+}
+
+func isReact(react string) bool {
+	for _, button := range reactionButtons {
+		if button.React == react {
+			return true
+		}
+	}
+	return false
+}
+
+// percent returns part of total in whole percents, 0 for empty total.
+func percent(part, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return part * 100 / total
+}
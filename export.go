@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pymq/tfahack/db"
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+const exportTimeLayout = "2006-01-02 15:04:05"
+
+var exportFormats = []string{"csv", "jsonl", "xlsx"}
+
+// exportRecord is one message in /export file.
+type exportRecord struct {
+	// Direction is sent for messages to the recipient and received for replies
+	Direction string `json:"direction"`
+	Name      string `json:"name"`
+	Username  string `json:"username"`
+	TGId      int64  `json:"tg_id"`
+	Time      string `json:"time"`
+	MediaType string `json:"media_type"`
+	Text      string `json:"text"`
+	Reaction  string `json:"reaction"`
+}
+
+var exportColumns = []string{"direction", "name", "username", "tg_id", "time", "media_type", "text", "reaction"}
+
+func newExportRecord(row db.TopicExportRow) exportRecord {
+	record := exportRecord{
+		Direction: "sent",
+		Name:      row.RecipientName,
+		Username:  row.RecipientTGName,
+		TGId:      row.RecipientTGId,
+		// SendDateTime keeps local time
+		Time:      row.SendDateTime.Format(exportTimeLayout),
+		MediaType: row.MediaType,
+		Text:      row.Message.Message,
+		Reaction:  row.React,
+	}
+	if row.IsRecipientMessage == 1 {
+		record.Direction = "received"
+	}
+	return record
+}
+
+func (r exportRecord) Strings() []string {
+	return []string{r.Direction, r.Name, r.Username, strconv.FormatInt(r.TGId, 10), r.Time, r.MediaType, r.Text, r.Reaction}
+}
+
+// command: /export <topic> [csv|jsonl|xlsx]
+func (b *Bot) handleExport(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return ctx.Send("Пожалуйста, введите данные в формате /export <IdТопика> [csv|jsonl|xlsx]")
+	}
+	format := "csv"
+	if len(args) == 2 {
+		format = strings.ToLower(args[1])
+	}
+	if !isExportFormat(format) {
+		return ctx.Send("Поддерживаются форматы csv, jsonl и xlsx")
+	}
+	topic, ok, err := b.findTopic(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	// the export goes to a temp file rather than memory, and the db isn't held busy while it's uploaded
+	file, err := os.CreateTemp("", "export-*."+format)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	err = b.writeTopicExport(file, topic, format)
+	if err != nil {
+		log.Errorf("export topic: %v", err)
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Send(&telebot.Document{
+		File:     telebot.FromReader(file),
+		FileName: fmt.Sprintf("%s.%s", topic.Topic, format),
+		Caption:  fmt.Sprintf("Переписка по топику '%s'", topic.Topic),
+	})
+	if err != nil {
+		log.Errorf("export topic: %v", err)
+	}
+	return err
+}
+
+func (b *Bot) writeTopicExport(w io.Writer, topic models.Topic, format string) error {
+	buf := bufio.NewWriter(w)
+	var write func(record exportRecord) error
+	var finish func() error
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(buf)
+		write = func(record exportRecord) error {
+			return writer.Write(record.Strings())
+		}
+		finish = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+		err := writer.Write(exportColumns)
+		if err != nil {
+			return err
+		}
+	case "jsonl":
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+		write = func(record exportRecord) error {
+			return encoder.Encode(record)
+		}
+		finish = func() error {
+			return nil
+		}
+	case "xlsx":
+		writer, err := newXLSXWriter(buf, topic.Topic)
+		if err != nil {
+			return err
+		}
+		write = func(record exportRecord) error {
+			return writer.Write(record.Strings())
+		}
+		finish = writer.Close
+		err = writer.Write(exportColumns)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown export format '%s'", format)
+	}
+
+	err := b.db.ExportTopicMessages(topic.TopicId, func(row db.TopicExportRow) error {
+		return write(newExportRecord(row))
+	})
+	if err != nil {
+		return fmt.Errorf("export topic messages: %v", err)
+	}
+	err = finish()
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+func isExportFormat(format string) bool {
+	for _, f := range exportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
@@ -3,14 +3,17 @@ module github.com/pymq/tfahack
 go 1.17
 
 require (
-	github.com/cespare/xxhash/v2 v2.1.2
+	github.com/BurntSushi/toml v1.2.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/uptrace/bun v1.1.1
 	github.com/uptrace/bun/dialect/sqlitedialect v1.1.1
 	github.com/uptrace/bun/driver/sqliteshim v1.1.1
 	github.com/uptrace/bun/extra/bundebug v1.1.1
 	golang.org/x/exp v0.0.0-20220318154914-8dddf5d87bd8
+	golang.org/x/image v0.1.0
+	golang.org/x/time v0.0.0-20220224211638-0e9765cccd65
 	gopkg.in/telebot.v3 v3.0.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -25,10 +28,9 @@ require (
 	github.com/tmthrgd/go-hex v0.0.0-20190904060850-447a3041c3bc // indirect
 	github.com/vmihailenco/msgpack/v5 v5.3.5 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
-	golang.org/x/mod v0.6.0-dev.0.20211013180041-c96bc1413d57 // indirect
-	golang.org/x/sys v0.0.0-20220227234510-4e6760a101f9 // indirect
-	golang.org/x/tools v0.1.9 // indirect
-	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
+	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
+	golang.org/x/tools v0.1.12 // indirect
 	lukechampine.com/uint128 v1.2.0 // indirect
 	modernc.org/cc/v3 v3.35.22 // indirect
 	modernc.org/ccgo/v3 v3.15.13 // indirect
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+// command: /list_invite <list> [label] [expires=<when>] [limit=<n>]
+// when: 2006-01-02T15:04 (server time) or +<duration>, e.g. +72h
+// Without options list's default link is returned, with options a new link is created.
+func (b *Bot) handleListInvite(ctx telebot.Context) error {
+	const usage = "Пожалуйста, введите данные в формате /list_invite <Название_списка> [канал] [expires=<+72h|2006-01-02T15:04>] [limit=<n>]\n" +
+		"канал - метка, по которой будет видно, откуда пришли подписчики, например site"
+	args := ctx.Args()
+	if len(args) < 1 {
+		return ctx.Send(usage)
+	}
+	list, ok, err := b.findMailingList(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	now := time.Now()
+	link := models.InviteLink{ListId: list.ListId, SenderTGId: list.SenderTGId, CreatedAt: now}
+	for _, arg := range args[1:] {
+		switch {
+		case strings.HasPrefix(arg, "expires="):
+			link.ExpiresAt, err = parseScheduleTime(strings.TrimPrefix(arg, "expires="), now)
+			if err != nil {
+				return ctx.Send(fmt.Sprintf("Неверный срок действия: %v\n\n%s", err, usage))
+			}
+		case strings.HasPrefix(arg, "limit="):
+			link.MaxUses, err = strconv.ParseInt(strings.TrimPrefix(arg, "limit="), 10, 64)
+			if err != nil || link.MaxUses <= 0 {
+				return ctx.Send(fmt.Sprintf("Неверное ограничение числа подписок\n\n%s", usage))
+			}
+		case link.Label == "":
+			link.Label = arg
+		default:
+			return ctx.Send(usage)
+		}
+	}
+
+	defaultLink := link.Label == "" && link.ExpiresAt.IsZero() && link.MaxUses == 0
+	if defaultLink {
+		existing, err := b.db.GetInviteLinkByList(list.ListId)
+		if err == nil {
+			return ctx.Send(formatInviteLink(list, existing, b.inviteURL(existing.Token)))
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	link.Token, err = newToken()
+	if err != nil {
+		return err
+	}
+	err = b.db.AddInviteLink(link)
+	if err != nil {
+		log.Errorf("list invite: %v", err)
+		return err
+	}
+	return ctx.Send(formatInviteLink(list, link, b.inviteURL(link.Token)))
+}
+
+// command: /invites
+func (b *Bot) handleInvites(ctx telebot.Context) error {
+	links, err := b.db.GetInviteLinksWithUsesBySender(senderOrgId(ctx))
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		return ctx.Send("У вас нет ссылок-приглашений. Создайте ссылку командой /list_invite <Название_списка>")
+	}
+
+	now := time.Now()
+	str := new(strings.Builder)
+	str.WriteString("Ваши ссылки-приглашения:")
+	for _, link := range links {
+		list, err := b.db.GetMailingListById(link.ListId)
+		if err != nil {
+			return err
+		}
+		label := link.Label
+		if label == "" {
+			label = "без канала"
+		}
+		_, _ = fmt.Fprintf(str, "\n\n%s - список '%s', канал '%s'\nподписок: %d", link.Token, list.ListName, label, link.Uses)
+		if link.MaxUses > 0 {
+			_, _ = fmt.Fprintf(str, " из %d", link.MaxUses)
+		}
+		_, _ = fmt.Fprintf(str, ", новых пользователей бота: %d", link.NewRecipients)
+		switch {
+		case link.Revoked:
+			str.WriteString("\nотключена")
+		case link.Expired(now):
+			str.WriteString("\nсрок действия истек")
+		case !link.ExpiresAt.IsZero():
+			_, _ = fmt.Fprintf(str, "\nдействует до %s", link.ExpiresAt.Local().Format(scheduleTimeLayout))
+		}
+	}
+	str.WriteString("\n\nПодписчики по ссылке: /invite_show <token>, отключить: /invite_revoke <token>")
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
+
+// command: /invite_show <token>
+func (b *Bot) handleInviteShow(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /invite_show <token>")
+	}
+	link, ok, err := b.senderInviteLink(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+	recipients, err := b.db.GetInviteUseRecipients(link.Token)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return ctx.Send("По этой ссылке еще никто не подписался")
+	}
+
+	str := new(strings.Builder)
+	_, _ = fmt.Fprintf(str, "Подписались по ссылке %s: %d", link.Token, len(recipients))
+	for _, recipient := range recipients {
+		_, _ = fmt.Fprintf(str, "\n%s", recipientFullTitle(recipient))
+	}
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
+
+// command: /invite_revoke <token>
+func (b *Bot) handleInviteRevoke(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /invite_revoke <token>")
+	}
+	link, ok, err := b.senderInviteLink(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+	err = b.db.RevokeInviteLink(link.Token)
+	if err != nil {
+		log.Errorf("revoke invite: %v", err)
+		return err
+	}
+	return ctx.Send("Ссылка отключена, подписавшиеся по ней остаются в списке")
+}
+
+// senderInviteLink returns sender's link by token. If ok is false, user is already notified.
+func (b *Bot) senderInviteLink(ctx telebot.Context, token string) (models.InviteLink, bool, error) {
+	link, err := b.db.GetInviteLinkByToken(token)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && link.SenderTGId != senderOrgId(ctx)) {
+		return models.InviteLink{}, false, ctx.Send("Ссылка не найдена, ваши ссылки: /invites")
+	}
+	if err != nil {
+		return models.InviteLink{}, false, err
+	}
+	return link, true, nil
+}
+
+// joinByInvite adds recipient to the list of invite token from /start payload and notifies the sender.
+func (b *Bot) joinByInvite(ctx telebot.Context, recipient models.Recipient, newRecipient bool, token, greeting string) error {
+	link, err := b.db.GetInviteLinkByToken(token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ctx.Send(greeting + "\n\nСсылка-приглашение недействительна")
+	}
+	if err != nil {
+		log.Errorf("join by invite: load link: %v", err)
+		return err
+	}
+
+	// the same recipient may follow the link again, e.g. after /stop, caps don't apply then
+	usedBefore, err := b.db.IsInviteUsedBy(link.Token, recipient.RecipientId)
+	if err != nil {
+		return err
+	}
+	if !usedBefore {
+		switch {
+		case link.Revoked:
+			return ctx.Send(greeting + "\n\nСсылка-приглашение отключена")
+		case link.Expired(time.Now()):
+			return ctx.Send(greeting + "\n\nСрок действия ссылки-приглашения истек")
+		}
+		// the use is saved before joining, so that it counts against the cap right away
+		claimed, err := b.db.ClaimInviteUse(models.InviteUse{
+			Token:        link.Token,
+			RecipientId:  recipient.RecipientId,
+			ListId:       link.ListId,
+			NewRecipient: newRecipient,
+			UsedAt:       time.Now(),
+		}, link.MaxUses)
+		if err != nil {
+			log.Errorf("join by invite: save use: %v", err)
+			return err
+		}
+		if !claimed {
+			// the recipient's other /start may have saved the use in the meantime
+			usedBefore, err = b.db.IsInviteUsedBy(link.Token, recipient.RecipientId)
+			if err != nil {
+				return err
+			}
+			if !usedBefore {
+				return ctx.Send(greeting + "\n\nЛимит подписок по этой ссылке исчерпан")
+			}
+		}
+	}
+
+	list, err := b.db.GetMailingListById(link.ListId)
+	if err != nil {
+		log.Errorf("join by invite: load list: %v", err)
+		return err
+	}
+	added, err := b.db.AddMailingListMembers(list.ListId, []int64{recipient.RecipientId})
+	if err != nil {
+		log.Errorf("join by invite: add member: %v", err)
+		return err
+	}
+	// following sender's invite link is an explicit consent to get its broadcasts again
+	err = b.db.DeleteOptOuts(recipient.RecipientId, list.SenderTGId, list.ListId)
+	if err != nil {
+		log.Errorf("join by invite: delete opt-outs: %v", err)
+		return err
+	}
+	if added > 0 {
+		b.notifyInviteJoin(link, list, recipient, newRecipient)
+	}
+	return ctx.Send(fmt.Sprintf("%s\n\nВы подписались на список рассылки '%s'", greeting, list.ListName))
+}
+
+func (b *Bot) notifyInviteJoin(link models.InviteLink, list models.MailingList, recipient models.Recipient, newRecipient bool) {
+	settings, err := b.db.GetSenderSettings(link.SenderTGId)
+	if err != nil {
+		log.Errorf("notify invite join: load settings: %v", err)
+		return
+	}
+
+	str := fmt.Sprintf("%s подписался на список '%s' по ссылке %s", recipientFullTitle(recipient), list.ListName, link.Token)
+	if link.Label != "" {
+		str += fmt.Sprintf(" (канал '%s')", link.Label)
+	}
+	if newRecipient {
+		str += ", новый пользователь бота"
+	}
+	b.notifyOrganization(link.SenderTGId, str, &telebot.SendOptions{DisableNotification: settings.InQuietHours(time.Now())})
+}
+
+func formatInviteLink(list models.MailingList, link models.InviteLink, url string) string {
+	str := fmt.Sprintf("Ссылка-приглашение в список '%s':\n%s", list.ListName, url)
+	if link.Label != "" {
+		str += fmt.Sprintf("\nканал: %s", link.Label)
+	}
+	if !link.ExpiresAt.IsZero() {
+		str += fmt.Sprintf("\nдействует до %s", link.ExpiresAt.Local().Format(scheduleTimeLayout))
+	}
+	if link.MaxUses > 0 {
+		str += fmt.Sprintf("\nлимит подписок: %d", link.MaxUses)
+	}
+	return str + "\n\nПерешедшие по ней пользователи подпишутся на бота и сразу попадут в список. Статистика: /invites"
+}
+
+func (b *Bot) inviteURL(token string) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s", b.client.Me.Username, token)
+}
+
+// newToken returns a random token that fits into deep link payload (up to 64 characters of A-Z, a-z, 0-9, _ and -)
+// and into callback data.
+func newToken() (string, error) {
+	buf := make([]byte, 12)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+const maxImportFileSize = 5 << 20
+
+// listEntry is one member in imported or exported list file.
+type listEntry struct {
+	Username string `json:"username,omitempty"`
+	TGId     int64  `json:"tg_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Status   string `json:"status,omitempty"`
+	// Fields are the rest columns, they are saved as recipient's template variables
+	Fields map[string]string `json:"-"`
+}
+
+// listEntryColumns are known columns, other ones are custom fields
+var listEntryColumns = map[string]struct{}{
+	"username": {}, "tg_name": {}, "telegram": {}, "tg_id": {}, "telegram_id": {}, "id": {}, "name": {}, "status": {},
+}
+
+func (e listEntry) String() string {
+	if e.Username != "" {
+		return "@" + e.Username
+	}
+	return strconv.FormatInt(e.TGId, 10)
+}
+
+// command: /import_list <list> [replace], as a reply to a .csv or .json document
+// csv has a header with "username" and/or "tg_id" columns, json is an array of {"username": "...", "tg_id": 123} or of usernames.
+// Other columns or keys are saved as recipients' fields for message templates, e.g. {{.city}}.
+// Without replace members are added to the list, with replace members missing in the file are removed.
+func (b *Bot) handleImportList(ctx telebot.Context) error {
+	const usage = "Отправьте боту .csv или .json файл и ответьте на него командой /import_list <Название_списка> [replace]\n" +
+		"csv: заголовок с колонками username и/или tg_id\njson: [{\"username\": \"...\", \"tg_id\": 123}] или [\"username1\", \"username2\"]\n" +
+		"остальные колонки сохраняются как поля получателей для шаблонов, например {{.city}}\n" +
+		"replace - удалить из списка участников, которых нет в файле"
+	args := ctx.Args()
+	replyTo := ctx.Message().ReplyTo
+	if replyTo == nil || replyTo.Document == nil || len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "replace") {
+		return ctx.Send(usage)
+	}
+	replace := len(args) == 2
+	document := replyTo.Document
+	if document.FileSize > maxImportFileSize {
+		return ctx.Send("Файл слишком большой, максимум 5 МБ")
+	}
+
+	reader, err := b.client.File(&document.File)
+	if err != nil {
+		log.Errorf("import list: download file: %v", err)
+		return err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxImportFileSize))
+	if err != nil {
+		log.Errorf("import list: read file: %v", err)
+		return err
+	}
+
+	var entries []listEntry
+	switch strings.ToLower(filepath.Ext(document.FileName)) {
+	case ".csv":
+		entries, err = parseListCSV(data)
+	case ".json":
+		entries, err = parseListJSON(data)
+	default:
+		return ctx.Send(usage)
+	}
+	if err != nil {
+		return ctx.Send(fmt.Sprintf("Не удалось разобрать файл: %v", err))
+	}
+	if len(entries) == 0 {
+		return ctx.Send("В файле нет получателей")
+	}
+
+	matchedIds, fields, unmatched, err := b.matchListEntries(entries)
+	if err != nil {
+		log.Errorf("import list: match recipients: %v", err)
+		return err
+	}
+
+	lists, err := b.db.GetMailingListsByName(senderOrgId(ctx), args[0])
+	if err != nil {
+		return err
+	}
+	var list models.MailingList
+	created := false
+	switch {
+	case len(lists) > 1:
+		return ctx.Send(fmt.Sprintf("Есть несколько списков с названием '%s', переименуйте их через /list_rename", args[0]))
+	case len(lists) == 1:
+		list = lists[0]
+	case len(matchedIds) == 0:
+		return ctx.Send(fmt.Sprintf("Не удалось создать список: никто из файла не подключен к боту (%d записей)", len(entries)))
+	default:
+		list = models.MailingList{ListName: args[0], SenderTGId: senderOrgId(ctx)}
+		err = b.db.AddMailingList(list, matchedIds)
+		if err != nil {
+			log.Errorf("import list: create list: %v", err)
+			return err
+		}
+		created = true
+	}
+
+	added := 0
+	if created {
+		added = len(matchedIds)
+	} else if len(matchedIds) > 0 {
+		added, err = b.db.AddMailingListMembers(list.ListId, matchedIds)
+		if err != nil {
+			log.Errorf("import list: add members: %v", err)
+			return err
+		}
+	}
+	removed := 0
+	if replace && !created {
+		removed, err = b.removeMembersExcept(list.ListId, matchedIds)
+		if err != nil {
+			log.Errorf("import list: remove members: %v", err)
+			return err
+		}
+	}
+
+	fieldNames, err := b.saveListEntryFields(senderOrgId(ctx), fields)
+	if err != nil {
+		log.Errorf("import list: save fields: %v", err)
+		return err
+	}
+
+	str := new(strings.Builder)
+	if created {
+		_, _ = fmt.Fprintf(str, "Список '%s' создан.", list.ListName)
+	} else {
+		_, _ = fmt.Fprintf(str, "Список '%s' обновлен.", list.ListName)
+	}
+	_, _ = fmt.Fprintf(str, "\nЗаписей в файле: %d\nНайдено в боте: %d\nДобавлено: %d", len(entries), len(matchedIds), added)
+	if replace {
+		_, _ = fmt.Fprintf(str, "\nУдалено: %d", removed)
+	}
+	if len(fieldNames) > 0 {
+		_, _ = fmt.Fprintf(str, "\nПоля для шаблонов: {{.%s}}", strings.Join(fieldNames, "}}, {{."))
+	}
+	if len(unmatched) > 0 {
+		_, _ = fmt.Fprintf(str, "\n\nНе подключены к боту (%d):", len(unmatched))
+		for _, entry := range unmatched {
+			_, _ = fmt.Fprintf(str, "\n%s", entry)
+		}
+	}
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
+
+// command: /export_list <list> [csv|json]
+func (b *Bot) handleExportList(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return ctx.Send("Пожалуйста, введите данные в формате /export_list <Название_списка> [csv|json]")
+	}
+	format := "csv"
+	if len(args) == 2 {
+		format = strings.ToLower(args[1])
+	}
+	if format != "csv" && format != "json" {
+		return ctx.Send("Поддерживаются форматы csv и json")
+	}
+	list, ok, err := b.findMailingList(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	members, err := b.db.GetMailingListMembers(list.ListId)
+	if err != nil {
+		return err
+	}
+	entries := make([]listEntry, len(members))
+	for i, member := range members {
+		status := "active"
+		switch {
+		case member.Unsubscribed:
+			status = "unsubscribed"
+		case member.Inactive:
+			status = member.InactiveReason
+		default:
+			optedOut, err := b.db.IsOptedOut(member.RecipientId, list.SenderTGId, list.ListId)
+			if err != nil {
+				return err
+			}
+			if optedOut {
+				status = "opted_out"
+			}
+		}
+		entries[i] = listEntry{Username: member.RecipientTGName, TGId: member.RecipientTGId, Name: member.RecipientName, Status: status}
+	}
+
+	var data []byte
+	if format == "csv" {
+		data, err = formatListCSV(entries)
+	} else {
+		data, err = json.MarshalIndent(entries, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	return ctx.Send(&telebot.Document{
+		File:     telebot.FromReader(bytes.NewReader(data)),
+		FileName: fmt.Sprintf("%s.%s", list.ListName, format),
+		Caption:  fmt.Sprintf("Список '%s', участников: %d", list.ListName, len(entries)),
+	})
+}
+
+// matchListEntries finds connected recipients by tg id or username, fields are entries' fields by RecipientId.
+func (b *Bot) matchListEntries(entries []listEntry) (matchedIds []int64, fields map[int64]map[string]string, unmatched []listEntry, err error) {
+	tgIds := make([]int64, 0, len(entries))
+	usernames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.TGId != 0 {
+			tgIds = append(tgIds, entry.TGId)
+		}
+		if entry.Username != "" {
+			usernames = append(usernames, entry.Username)
+		}
+	}
+
+	byTGId := make(map[int64]models.Recipient)
+	if len(tgIds) > 0 {
+		recipients, err := b.db.GetRecipientsByIds(tgIds)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, recipient := range recipients {
+			byTGId[recipient.RecipientTGId] = recipient
+		}
+	}
+	byUsername := make(map[string]models.Recipient)
+	if len(usernames) > 0 {
+		recipients, err := b.db.GetRecipientsByTGNames(usernames)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		byOldName, err := b.db.GetRecipientsByOldTGNames(usernames)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for oldName, recipient := range byOldName {
+			byUsername[strings.ToLower(oldName)] = recipient
+		}
+		// current usernames take precedence over old ones
+		for _, recipient := range recipients {
+			byUsername[strings.ToLower(recipient.RecipientTGName)] = recipient
+		}
+	}
+
+	seen := make(map[int64]struct{})
+	fields = make(map[int64]map[string]string)
+	for _, entry := range entries {
+		recipient, ok := byTGId[entry.TGId]
+		if !ok && entry.Username != "" {
+			recipient, ok = byUsername[strings.ToLower(entry.Username)]
+		}
+		if !ok {
+			unmatched = append(unmatched, entry)
+			continue
+		}
+		for name, value := range entry.Fields {
+			if fields[recipient.RecipientId] == nil {
+				fields[recipient.RecipientId] = make(map[string]string)
+			}
+			fields[recipient.RecipientId][name] = value
+		}
+		if _, ok := seen[recipient.RecipientId]; ok {
+			continue
+		}
+		seen[recipient.RecipientId] = struct{}{}
+		matchedIds = append(matchedIds, recipient.RecipientId)
+	}
+	return matchedIds, fields, unmatched, nil
+}
+
+// saveListEntryFields saves imported fields of the recipients and returns sorted names of the fields.
+func (b *Bot) saveListEntryFields(senderTGId int64, fields map[int64]map[string]string) ([]string, error) {
+	rows := make([]models.RecipientField, 0)
+	names := make(map[string]struct{})
+	for recipientId, recipientFields := range fields {
+		for name, value := range recipientFields {
+			rows = append(rows, models.RecipientField{SenderTGId: senderTGId, RecipientId: recipientId, Name: name, Value: value})
+			names[name] = struct{}{}
+		}
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	err := b.db.SaveRecipientFields(rows)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+func (b *Bot) removeMembersExcept(listId int64, keepIds []int64) (int, error) {
+	members, err := b.db.GetMailingListMembers(listId)
+	if err != nil {
+		return 0, err
+	}
+	keep := make(map[int64]struct{}, len(keepIds))
+	for _, id := range keepIds {
+		keep[id] = struct{}{}
+	}
+	removeIds := make([]int64, 0)
+	for _, member := range members {
+		if _, ok := keep[member.RecipientId]; !ok {
+			removeIds = append(removeIds, member.RecipientId)
+		}
+	}
+	if len(removeIds) == 0 {
+		return 0, nil
+	}
+	return b.db.RemoveMailingListMembers(listId, removeIds)
+}
+
+func parseListCSV(data []byte) ([]listEntry, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	usernameIdx, tgIdIdx := -1, -1
+	fieldColumns := make(map[int]string)
+	for i, column := range records[0] {
+		column = strings.TrimSpace(column)
+		switch strings.ToLower(column) {
+		case "username", "tg_name", "telegram":
+			usernameIdx = i
+		case "tg_id", "telegram_id", "id":
+			tgIdIdx = i
+		}
+		if _, ok := listEntryColumns[strings.ToLower(column)]; ok || column == "" {
+			continue
+		}
+		if !isTemplateFieldName(column) {
+			return nil, fmt.Errorf("колонка '%s' не подходит для шаблонов: название из букв, цифр и _, не с цифры, кроме %s и %s",
+				column, templateVarRecipientName, templateVarTGName)
+		}
+		fieldColumns[i] = column
+	}
+	if usernameIdx < 0 && tgIdIdx < 0 {
+		return nil, errors.New("в заголовке нет колонки username или tg_id")
+	}
+
+	entries := make([]listEntry, 0, len(records)-1)
+	for line, record := range records[1:] {
+		entry := listEntry{}
+		if usernameIdx >= 0 && usernameIdx < len(record) {
+			entry.Username = strings.TrimPrefix(strings.TrimSpace(record[usernameIdx]), "@")
+		}
+		if tgIdIdx >= 0 && tgIdIdx < len(record) && strings.TrimSpace(record[tgIdIdx]) != "" {
+			entry.TGId, err = strconv.ParseInt(strings.TrimSpace(record[tgIdIdx]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("строка %d: неверный tg_id '%s'", line+2, record[tgIdIdx])
+			}
+		}
+		if entry.Username == "" && entry.TGId == 0 {
+			continue
+		}
+		for i, name := range fieldColumns {
+			// empty value is a missing variable, so templates using it aren't sent to the recipient
+			if i < len(record) && strings.TrimSpace(record[i]) != "" {
+				if entry.Fields == nil {
+					entry.Fields = make(map[string]string)
+				}
+				entry.Fields[name] = strings.TrimSpace(record[i])
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func parseListJSON(data []byte) ([]listEntry, error) {
+	var usernames []string
+	if err := json.Unmarshal(data, &usernames); err == nil {
+		entries := make([]listEntry, 0, len(usernames))
+		for _, username := range usernames {
+			if username = strings.TrimPrefix(strings.TrimSpace(username), "@"); username != "" {
+				entries = append(entries, listEntry{Username: username})
+			}
+		}
+		return entries, nil
+	}
+
+	var entries []listEntry
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	var objects []map[string]json.RawMessage
+	err = json.Unmarshal(data, &objects)
+	if err != nil {
+		return nil, err
+	}
+	for i, object := range objects {
+		entries[i].Fields, err = parseListJSONFields(object)
+		if err != nil {
+			return nil, fmt.Errorf("запись %d: %v", i+1, err)
+		}
+	}
+	n := 0
+	for _, entry := range entries {
+		entry.Username = strings.TrimPrefix(strings.TrimSpace(entry.Username), "@")
+		if entry.Username == "" && entry.TGId == 0 {
+			continue
+		}
+		entries[n] = entry
+		n++
+	}
+	return entries[:n], nil
+}
+
+// parseListJSONFields returns unknown keys of the entry with string, number or bool values as fields.
+func parseListJSONFields(object map[string]json.RawMessage) (map[string]string, error) {
+	var fields map[string]string
+	for name, raw := range object {
+		if _, ok := listEntryColumns[strings.ToLower(name)]; ok {
+			continue
+		}
+		if !isTemplateFieldName(name) {
+			return nil, fmt.Errorf("ключ '%s' не подходит для шаблонов: название из букв, цифр и _, не с цифры, кроме %s и %s",
+				name, templateVarRecipientName, templateVarTGName)
+		}
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		err := decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+		var str string
+		switch v := value.(type) {
+		case nil:
+			continue
+		case string:
+			str = strings.TrimSpace(v)
+		case json.Number:
+			str = v.String()
+		case bool:
+			str = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("значение '%s' должно быть строкой или числом", name)
+		}
+		if str == "" {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[name] = str
+	}
+	return fields, nil
+}
+
+func formatListCSV(entries []listEntry) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := csv.NewWriter(buf)
+	err := writer.Write([]string{"username", "tg_id", "name", "status"})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		err = writer.Write([]string{entry.Username, strconv.FormatInt(entry.TGId, 10), entry.Name, entry.Status})
+		if err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+func (b *Bot) initListsHandlers(viewers, editors *telebot.Group) {
+	viewers.Handle("/lists", b.handleLists)
+	viewers.Handle("/list_show", b.handleListShow)
+	editors.Handle("/list_add", b.handleListAdd)
+	editors.Handle("/list_remove", b.handleListRemove)
+	editors.Handle("/list_rename", b.handleListRename)
+	editors.Handle("/list_delete", b.handleListDelete)
+	editors.Handle("/list_invite", b.handleListInvite)
+	viewers.Handle("/invites", b.handleInvites)
+	viewers.Handle("/invite_show", b.handleInviteShow)
+	editors.Handle("/invite_revoke", b.handleInviteRevoke)
+	editors.Handle("/import_list", b.handleImportList)
+	viewers.Handle("/export_list", b.handleExportList)
+}
+
+// resolveRecipients finds connected recipients by @usernames or numeric telegram ids, errors has a line for every unknown one.
+func (b *Bot) resolveRecipients(names []string) (recipientsIds []int64, errors []string, err error) {
+	uniqueRecipients := make(map[string]struct{})
+	usernames := make([]string, 0, len(names))
+	tgIds := make([]int64, 0)
+	recipients := make([]string, 0, len(names))
+	for _, recipient := range names {
+		recipient = strings.TrimPrefix(recipient, "@")
+		// usernames are case-insensitive
+		if _, ok := uniqueRecipients[strings.ToLower(recipient)]; ok || recipient == "" {
+			continue
+		}
+		uniqueRecipients[strings.ToLower(recipient)] = struct{}{}
+		recipients = append(recipients, recipient)
+		// usernames can't start with a digit
+		if tgId, err := strconv.ParseInt(recipient, 10, 64); err == nil {
+			tgIds = append(tgIds, tgId)
+		} else {
+			usernames = append(usernames, recipient)
+		}
+	}
+
+	recipientsInfo := make([]models.Recipient, 0, len(recipients))
+	if len(usernames) > 0 {
+		found, err := b.db.GetRecipientsByTGNames(usernames)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, recipient := range found {
+			delete(uniqueRecipients, strings.ToLower(recipient.RecipientTGName))
+		}
+		recipientsInfo = append(recipientsInfo, found...)
+
+		// users could change username since they were added
+		oldNames := make([]string, 0)
+		for _, username := range usernames {
+			if _, ok := uniqueRecipients[strings.ToLower(username)]; ok {
+				oldNames = append(oldNames, username)
+			}
+		}
+		if len(oldNames) > 0 {
+			byOldName, err := b.db.GetRecipientsByOldTGNames(oldNames)
+			if err != nil {
+				return nil, nil, err
+			}
+			for oldName, recipient := range byOldName {
+				delete(uniqueRecipients, strings.ToLower(oldName))
+				recipientsInfo = append(recipientsInfo, recipient)
+			}
+		}
+	}
+	if len(tgIds) > 0 {
+		found, err := b.db.GetRecipientsByIds(tgIds)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, recipient := range found {
+			delete(uniqueRecipients, strconv.FormatInt(recipient.RecipientTGId, 10))
+		}
+		recipientsInfo = append(recipientsInfo, found...)
+	}
+
+	// the same recipient may be found by username, old username and telegram id
+	seen := make(map[int64]struct{}, len(recipientsInfo))
+	recipientsIds = make([]int64, 0, len(recipientsInfo))
+	for _, recipient := range recipientsInfo {
+		if _, ok := seen[recipient.RecipientId]; ok {
+			continue
+		}
+		seen[recipient.RecipientId] = struct{}{}
+		recipientsIds = append(recipientsIds, recipient.RecipientId)
+	}
+
+	errors = make([]string, 0, len(uniqueRecipients))
+	for _, recipient := range recipients {
+		if _, ok := uniqueRecipients[strings.ToLower(recipient)]; !ok {
+			continue
+		}
+		if _, err := strconv.ParseInt(recipient, 10, 64); err == nil {
+			errors = append(errors, fmt.Sprintf("%s - Пользователь не подключен к боту", recipient))
+		} else {
+			errors = append(errors, fmt.Sprintf("@%s - Пользователь не подключен к боту", recipient))
+		}
+	}
+	return recipientsIds, errors, nil
+}
+
+// commandRecipients resolves recipients from command arguments and from a forwarded message
+// or a shared contact the command replies to.
+func (b *Bot) commandRecipients(ctx telebot.Context, names []string) (recipientsIds []int64, errors []string, err error) {
+	reply := ctx.Message().ReplyTo
+	if reply != nil {
+		switch {
+		case reply.OriginalSender != nil:
+			names = append(names, strconv.FormatInt(reply.OriginalSender.ID, 10))
+		case reply.OriginalSenderName != "":
+			errors = append(errors, fmt.Sprintf("%s - Пользователь скрыл аккаунт в пересланных сообщениях, добавьте его по ссылке-приглашению /list_invite", reply.OriginalSenderName))
+		case reply.Contact != nil && reply.Contact.UserID != 0:
+			names = append(names, strconv.FormatInt(reply.Contact.UserID, 10))
+		case reply.Contact != nil:
+			errors = append(errors, fmt.Sprintf("%s - Контакт не зарегистрирован в Telegram", reply.Contact.PhoneNumber))
+		}
+	}
+
+	recipientsIds, resolveErrors, err := b.resolveRecipients(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	return recipientsIds, append(errors, resolveErrors...), nil
+}
+
+// hasReplyRecipient reports whether the command replies to a forwarded message or a shared contact.
+func hasReplyRecipient(msg *telebot.Message) bool {
+	return msg.ReplyTo != nil && (msg.ReplyTo.IsForwarded() || msg.ReplyTo.OriginalSenderName != "" || msg.ReplyTo.Contact != nil)
+}
+
+// recipientTitle is @username, or name with telegram id for users without username.
+func recipientTitle(recipient models.Recipient) string {
+	if recipient.RecipientTGName == "" {
+		return fmt.Sprintf("%s (id %d)", recipient.RecipientName, recipient.RecipientTGId)
+	}
+	return "@" + recipient.RecipientTGName
+}
+
+// recipientFullTitle is recipientTitle with name.
+func recipientFullTitle(recipient models.Recipient) string {
+	if recipient.RecipientTGName == "" {
+		return recipientTitle(recipient)
+	}
+	return fmt.Sprintf("@%s (%s)", recipient.RecipientTGName, recipient.RecipientName)
+}
+
+// findMailingList looks up sender's list by name or by id. If ok is false, user is already notified.
+func (b *Bot) findMailingList(ctx telebot.Context, nameOrId string) (models.MailingList, bool, error) {
+	lists, err := b.db.GetMailingListsByName(senderOrgId(ctx), nameOrId)
+	if err != nil {
+		return models.MailingList{}, false, err
+	}
+	if len(lists) == 1 {
+		return lists[0], true, nil
+	}
+	if len(lists) > 1 {
+		return models.MailingList{}, false, ctx.Send(fmt.Sprintf("Есть несколько списков с названием '%s', укажите id списка из /lists", nameOrId))
+	}
+
+	listId, err := strconv.ParseInt(strings.TrimPrefix(nameOrId, "#"), 10, 64)
+	if err == nil {
+		list, err := b.db.GetMailingListById(listId)
+		if err == nil && list.SenderTGId == senderOrgId(ctx) {
+			return list, true, nil
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return models.MailingList{}, false, err
+		}
+	}
+	return models.MailingList{}, false, ctx.Send(fmt.Sprintf("Список '%s' не найден, ваши списки: /lists", nameOrId))
+}
+
+// command: /lists
+func (b *Bot) handleLists(ctx telebot.Context) error {
+	lists, err := b.db.GetMailingListsWithCountsBySender(senderOrgId(ctx))
+	if err != nil {
+		return err
+	}
+	if len(lists) == 0 {
+		return ctx.Send("У вас нет списков рассылки. Создайте список командой /create_mailing_list")
+	}
+
+	str := new(strings.Builder)
+	str.WriteString("Ваши списки рассылки:")
+	for _, list := range lists {
+		_, _ = fmt.Fprintf(str, "\n#%d %s: %d участников", list.ListId, list.ListName, list.MembersCount)
+	}
+	str.WriteString("\n\nПодробнее: /list_show <список>")
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
+
+// command: /list_show <list>
+func (b *Bot) handleListShow(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /list_show <Название_списка>")
+	}
+	list, ok, err := b.findMailingList(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+	members, err := b.db.GetMailingListMembers(list.ListId)
+	if err != nil {
+		return err
+	}
+
+	str := new(strings.Builder)
+	_, _ = fmt.Fprintf(str, "Список #%d %s, участников: %d", list.ListId, list.ListName, len(members))
+	for _, member := range members {
+		_, _ = fmt.Fprintf(str, "\n%s", recipientFullTitle(member))
+		switch {
+		case member.Unsubscribed:
+			str.WriteString(" - отписался")
+		case member.Inactive:
+			_, _ = fmt.Fprintf(str, " - %s", inactiveReasonName(member.InactiveReason))
+		}
+	}
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
+
+// command: /list_add <list> <recipient1> <recipient2> <...>
+func (b *Bot) handleListAdd(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) < 1 || (len(args) < 2 && !hasReplyRecipient(ctx.Message())) {
+		return ctx.Send("Пожалуйста, введите данные в формате /list_add <Название_списка> <Получатель1> <Получатель2> <...>\n" +
+			"Получатель - @username или числовой Telegram ID. Также можно ответить командой на пересланное сообщение пользователя или его контакт")
+	}
+	list, ok, err := b.findMailingList(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	recipientsIds, errors, err := b.commandRecipients(ctx, args[1:])
+	if err != nil {
+		log.Errorf("add list members: load recipients: %v", err)
+		return err
+	}
+	added := 0
+	if len(recipientsIds) > 0 {
+		added, err = b.db.AddMailingListMembers(list.ListId, recipientsIds)
+		if err != nil {
+			log.Errorf("add list members: %v", err)
+			return err
+		}
+	}
+
+	str := fmt.Sprintf("Добавлено в список '%s': %d", list.ListName, added)
+	if len(errors) > 0 {
+		str += fmt.Sprintf("\n\nНе удалось добавить некоторых пользователей:\n%s", strings.Join(errors, ",\n"))
+	}
+	return ctx.Send(str)
+}
+
+// command: /list_remove <list> <recipient1> <recipient2> <...>
+func (b *Bot) handleListRemove(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) < 1 || (len(args) < 2 && !hasReplyRecipient(ctx.Message())) {
+		return ctx.Send("Пожалуйста, введите данные в формате /list_remove <Название_списка> <Получатель1> <Получатель2> <...>")
+	}
+	list, ok, err := b.findMailingList(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	recipientsIds, errors, err := b.commandRecipients(ctx, args[1:])
+	if err != nil {
+		log.Errorf("remove list members: load recipients: %v", err)
+		return err
+	}
+	removed := 0
+	if len(recipientsIds) > 0 {
+		removed, err = b.db.RemoveMailingListMembers(list.ListId, recipientsIds)
+		if err != nil {
+			log.Errorf("remove list members: %v", err)
+			return err
+		}
+	}
+
+	str := fmt.Sprintf("Удалено из списка '%s': %d", list.ListName, removed)
+	if len(errors) > 0 {
+		str += fmt.Sprintf("\n\nНе удалось удалить некоторых пользователей:\n%s", strings.Join(errors, ",\n"))
+	}
+	return ctx.Send(str)
+}
+
+// command: /list_rename <list> <new_name>
+func (b *Bot) handleListRename(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 2 {
+		return ctx.Send("Пожалуйста, введите данные в формате /list_rename <Название_списка> <Новое_название>")
+	}
+	list, ok, err := b.findMailingList(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+	existing, err := b.db.GetMailingListsByName(senderOrgId(ctx), args[1])
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return ctx.Send(fmt.Sprintf("Список '%s' уже существует", args[1]))
+	}
+
+	err = b.db.RenameMailingList(list.ListId, args[1])
+	if err != nil {
+		log.Errorf("rename list: %v", err)
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Список '%s' переименован в '%s'", list.ListName, args[1]))
+}
+
+// command: /list_delete <list>
+func (b *Bot) handleListDelete(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /list_delete <Название_списка>")
+	}
+	list, ok, err := b.findMailingList(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	err = b.db.DeleteMailingList(list.ListId)
+	if err != nil {
+		log.Errorf("delete list: %v", err)
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Список '%s' удален, запланированные рассылки по нему отменены", list.ListName))
+}
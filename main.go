@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,23 +11,41 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-type Config struct {
-	APIToken     string
-	AdminIDs     []int64
-	LogAllEvents bool
-}
-
 func main() {
-	botDB, err := db.NewDB()
+	configPath := flag.String("config", "", "path to config file (.yaml, .toml or .json)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-config path] [migrate status|up|down]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
 	if err != nil {
-		log.Panicf("init db: %v", err)
+		log.Fatalf("load config: %v", err)
 	}
+	level, _ := log.ParseLevel(cfg.LogLevel)
+	log.SetLevel(level)
 
-	cfg := Config{
-		// TODO from file?
-		AdminIDs:     nil,
-		APIToken:     "",
-		LogAllEvents: true,
+	if flag.Arg(0) == "migrate" {
+		// migrations need only the db, so the bot settings aren't validated
+		err = cfg.ValidateDB()
+		if err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+		err = runMigrateCommand(cfg, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+	err = cfg.Validate()
+	if err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+
+	botDB, err := db.NewDB(cfg.DBPath)
+	if err != nil {
+		log.Panicf("init db: %v", err)
 	}
 
 	bot, err := NewBot(cfg, botDB)
@@ -41,3 +61,51 @@ func main() {
 	bot.Close()
 	botDB.Close()
 }
+
+// command: migrate status|up|down, down rolls back one migration
+func runMigrateCommand(cfg Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected one of: status, up, down")
+	}
+
+	migrator, err := db.NewMigrator(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	switch args[0] {
+	case "status":
+		migrations, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			status := "pending"
+			if m.IsApplied() {
+				status = fmt.Sprintf("applied (group %d, %s)", m.GroupID, m.MigratedAt.Format("2006-01-02 15:04:05"))
+			}
+			fmt.Printf("%s %s\n", m.Name, status)
+		}
+	case "up":
+		group, err := migrator.Up()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("migrated: %s\n", group)
+	case "down":
+		migration, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			fmt.Println("there are no applied migrations")
+			return nil
+		}
+		fmt.Printf("rolled back: %s\n", migration.Name)
+	default:
+		return fmt.Errorf("unknown subcommand '%s', expected one of: status, up, down", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pymq/tfahack/models"
+	"gopkg.in/telebot.v3"
+)
+
+// mediaEndpoints are update types of media messages that are handled like text ones.
+var mediaEndpoints = []string{
+	telebot.OnPhoto,
+	telebot.OnDocument,
+	telebot.OnVideo,
+	telebot.OnVoice,
+	telebot.OnAudio,
+	telebot.OnAnimation,
+	telebot.OnVideoNote,
+}
+
+// MessageContent is what gets stored in models.Message and can be re-sent with sendContent.
+type MessageContent struct {
+	MediaType string
+	FileId    string
+	// Text is the message text or media caption
+	Text string
+	// Template means Text is rendered for every recipient with their variables, see renderTemplate
+	Template bool
+}
+
+func messageContent(msg *telebot.Message) MessageContent {
+	media := msg.Media()
+	if media == nil {
+		return MessageContent{Text: msg.Text}
+	}
+	return MessageContent{
+		MediaType: media.MediaType(),
+		FileId:    media.MediaFile().FileID,
+		Text:      msg.Caption,
+	}
+}
+
+func storedContent(message models.Message) MessageContent {
+	return MessageContent{MediaType: message.MediaType, FileId: message.FileId, Text: message.Message}
+}
+
+func (c MessageContent) IsEmpty() bool {
+	return c.FileId == "" && c.Text == ""
+}
+
+// Sendable returns value that can be passed to telebot.Bot.Send.
+func (c MessageContent) Sendable() (interface{}, error) {
+	file := telebot.File{FileID: c.FileId}
+	switch c.MediaType {
+	case "":
+		return c.Text, nil
+	case "photo":
+		return &telebot.Photo{File: file, Caption: c.Text}, nil
+	case "document":
+		return &telebot.Document{File: file, Caption: c.Text}, nil
+	case "video":
+		return &telebot.Video{File: file, Caption: c.Text}, nil
+	case "voice":
+		return &telebot.Voice{File: file, Caption: c.Text}, nil
+	case "audio":
+		return &telebot.Audio{File: file, Caption: c.Text}, nil
+	case "animation":
+		return &telebot.Animation{File: file, Caption: c.Text}, nil
+	case "videoNote":
+		return &telebot.VideoNote{File: file}, nil
+	default:
+		return nil, fmt.Errorf("unsupported media type '%s'", c.MediaType)
+	}
+}
+
+// Preview is a text representation used where the media itself can't be shown, e.g. in edited paging messages.
+func (c MessageContent) Preview() string {
+	if c.MediaType == "" {
+		return c.Text
+	}
+	if c.Text == "" {
+		return fmt.Sprintf("[%s]", mediaTypeName(c.MediaType))
+	}
+	return fmt.Sprintf("[%s] %s", mediaTypeName(c.MediaType), c.Text)
+}
+
+func mediaTypeName(mediaType string) string {
+	switch mediaType {
+	case "photo":
+		return "фото"
+	case "document":
+		return "документ"
+	case "video":
+		return "видео"
+	case "voice":
+		return "голосовое"
+	case "audio":
+		return "аудио"
+	case "animation":
+		return "анимация"
+	case "videoNote":
+		return "видеосообщение"
+	case models.MessageMediaPoll:
+		return "опрос"
+	default:
+		return mediaType
+	}
+}
+
+func (b *Bot) sendContent(to telebot.Recipient, content MessageContent, opts ...interface{}) (*telebot.Message, error) {
+	what, err := content.Sendable()
+	if err != nil {
+		return nil, err
+	}
+	return b.client.Send(to, what, opts...)
+}
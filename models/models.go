@@ -11,8 +11,22 @@ type Recipient struct {
 
 	RecipientId     int64  `bun:"RecipientId,pk,autoincrement,unique"`
 	RecipientName   string `bun:"RecipientName,notnull"`
-	RecipientTGName string `bun:"RecipientTGName,notnull,unique"`
+	RecipientTGName string `bun:"RecipientTGName,notnull"` // empty for users without username
 	RecipientTGId   int64  `bun:"RecipientTGId,notnull,unique"`
+	// Inactive recipients blocked the bot or deleted account, they are skipped in broadcasts until next /start
+	Inactive       bool   `bun:"Inactive,notnull"`
+	InactiveReason string `bun:"InactiveReason,notnull"`
+	// Unsubscribed recipients sent /stop and get no broadcasts at all
+	Unsubscribed bool `bun:"Unsubscribed,notnull"`
+}
+
+// RecipientUsername is recipient's previous username, old handles still resolve to the recipient.
+type RecipientUsername struct {
+	bun.BaseModel `bun:"table:RecipientUsernames,alias:recipientUsername"`
+
+	RecipientId int64     `bun:"RecipientId,pk"`
+	Username    string    `bun:"Username,pk"`
+	ReplacedAt  time.Time `bun:"ReplacedAt,notnull"`
 }
 
 type MailingList struct {
@@ -49,7 +63,318 @@ type Message struct {
 	ListId             int64     `bun:"ListId,notnull"`
 	SendDateTime       time.Time `bun:"SendDateTime,notnull"`
 	Message            string    `bun:"Message,notnull"`
-	React              string    `bun:"React"`
-	Read               int64     `bun:"Read,notnull"`
+	MediaType          string    `bun:"MediaType,notnull"` // empty for text, Message holds caption for media
+	FileId             string    `bun:"FileId,notnull"`
+	React              string    `bun:"React"`        // reaction button pressed by the recipient, see ReactUp etc.
+	Read               int64     `bun:"Read,notnull"` // 1 after the recipient pressed a button on the message or replied to it
 	IsRecipientMessage int64     `bun:"IsRecipientMessage,notnull"`
 }
+
+// Message.React values
+const (
+	ReactUp   = "up"
+	ReactDown = "down"
+	ReactOk   = "ok"
+)
+
+type SenderSettings struct {
+	bun.BaseModel `bun:"table:SenderSettings,alias:senderSettings"`
+
+	SenderTGId           int64 `bun:"SenderTGId,pk"`
+	NotificationsEnabled bool  `bun:"NotificationsEnabled,notnull"`
+	// quiet hours are in server local time, From > To means the window wraps midnight
+	QuietHoursEnabled bool  `bun:"QuietHoursEnabled,notnull"`
+	QuietHoursFrom    int64 `bun:"QuietHoursFrom,notnull"`
+	QuietHoursTo      int64 `bun:"QuietHoursTo,notnull"`
+	// replies are collected into a periodic digest instead of being forwarded one by one
+	DigestMode          bool  `bun:"DigestMode,notnull"`
+	LastDigestMessageId int64 `bun:"LastDigestMessageId,notnull"`
+}
+
+// DefaultSenderSettings are settings of a sender who hasn't changed them, reply notifications are off until enabled with /notifications_config.
+func DefaultSenderSettings(senderTGId int64) SenderSettings {
+	return SenderSettings{SenderTGId: senderTGId}
+}
+
+// InQuietHours reports whether t (hour precision) falls into the quiet hours window.
+func (s SenderSettings) InQuietHours(t time.Time) bool {
+	if !s.QuietHoursEnabled || s.QuietHoursFrom == s.QuietHoursTo {
+		return false
+	}
+	hour := int64(t.Hour())
+	if s.QuietHoursFrom < s.QuietHoursTo {
+		return hour >= s.QuietHoursFrom && hour < s.QuietHoursTo
+	}
+	return hour >= s.QuietHoursFrom || hour < s.QuietHoursTo
+}
+
+// Conversation is a state of a multi-step dialog with a chat, e.g. broadcast wizard.
+type Conversation struct {
+	bun.BaseModel `bun:"table:Conversations,alias:conversation"`
+
+	ChatId    int64     `bun:"ChatId,pk"`
+	State     string    `bun:"State,notnull"`
+	Data      string    `bun:"Data,notnull"`
+	UpdatedAt time.Time `bun:"UpdatedAt,notnull"`
+}
+
+const (
+	JobStatusPending   = "pending"
+	JobStatusDone      = "done"
+	JobStatusCancelled = "cancelled"
+)
+
+// Job is a scheduled broadcast. Recurring jobs stay pending and move RunAt forward by RepeatEvery.
+type Job struct {
+	bun.BaseModel `bun:"table:Jobs,alias:job"`
+
+	JobId       int64         `bun:"JobId,pk,autoincrement,unique"`
+	SenderTGId  int64         `bun:"SenderTGId,notnull"`
+	TopicId     int64         `bun:"TopicId,notnull"`
+	ListId      int64         `bun:"ListId,notnull"`
+	Message     string        `bun:"Message,notnull"`
+	MediaType   string        `bun:"MediaType,notnull"`
+	FileId      string        `bun:"FileId,notnull"`
+	RunAt       time.Time     `bun:"RunAt,notnull"`
+	RepeatEvery time.Duration `bun:"RepeatEvery,notnull"`
+	Status      string        `bun:"Status,notnull"`
+	Template    bool          `bun:"Template,notnull"` // Message is rendered for every recipient, see Broadcast.Template
+}
+
+const (
+	BroadcastStatusRunning = "running"
+	BroadcastStatusDone    = "done"
+)
+
+type Broadcast struct {
+	bun.BaseModel `bun:"table:Broadcasts,alias:broadcast"`
+
+	BroadcastId int64     `bun:"BroadcastId,pk,autoincrement,unique"`
+	SenderTGId  int64     `bun:"SenderTGId,notnull"`
+	TopicId     int64     `bun:"TopicId,notnull"`
+	ListId      int64     `bun:"ListId,notnull"`
+	Message     string    `bun:"Message,notnull"`
+	MediaType   string    `bun:"MediaType,notnull"`
+	FileId      string    `bun:"FileId,notnull"`
+	Status      string    `bun:"Status,notnull"`
+	CreatedAt   time.Time `bun:"CreatedAt,notnull"`
+	Reactions   bool      `bun:"Reactions,notnull"` // reaction buttons are attached to delivered messages
+	PollId      int64     `bun:"PollId,notnull"`    // 0 for regular messages, Message is the poll question then
+	Template    bool      `bun:"Template,notnull"`  // Message is a text/template rendered for every recipient
+}
+
+const (
+	RecipientInactiveBlocked     = "blocked"
+	RecipientInactiveDeactivated = "deactivated"
+	RecipientInactiveNotFound    = "chat_not_found"
+)
+
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSent    = "sent"
+	DeliveryStatusFailed  = "failed"
+	DeliveryStatusBlocked = "blocked"
+	// recipient was already inactive when broadcast was created
+	DeliveryStatusSkipped = "skipped"
+	// recipient unsubscribed after broadcast was created
+	DeliveryStatusUnsubscribed = "unsubscribed"
+)
+
+// Delivery is a state of one broadcast message to one recipient.
+type Delivery struct {
+	bun.BaseModel `bun:"table:Deliveries,alias:delivery"`
+
+	BroadcastId   int64     `bun:"BroadcastId,pk"`
+	RecipientId   int64     `bun:"RecipientId,pk"`
+	RecipientTGId int64     `bun:"RecipientTGId,notnull"`
+	Status        string    `bun:"Status,notnull"`
+	Error         string    `bun:"Error,notnull"`
+	Attempts      int64     `bun:"Attempts,notnull"`
+	MessageTGId   int64     `bun:"MessageTGId,notnull"`
+	UpdatedAt     time.Time `bun:"UpdatedAt,notnull"`
+}
+
+// OptOut is recipient's unsubscription from a sender's list, or from all sender's lists when ListId is 0.
+type OptOut struct {
+	bun.BaseModel `bun:"table:OptOuts,alias:optOut"`
+
+	RecipientId int64     `bun:"RecipientId,pk"`
+	SenderTGId  int64     `bun:"SenderTGId,pk"`
+	ListId      int64     `bun:"ListId,pk"`
+	CreatedAt   time.Time `bun:"CreatedAt,notnull"`
+}
+
+// InviteLink is a token of deep link t.me/<bot>?start=<token> that subscribes user to the list.
+type InviteLink struct {
+	bun.BaseModel `bun:"table:InviteLinks,alias:inviteLink"`
+
+	Token      string    `bun:"Token,pk"`
+	ListId     int64     `bun:"ListId,notnull"`
+	SenderTGId int64     `bun:"SenderTGId,notnull"`
+	CreatedAt  time.Time `bun:"CreatedAt,notnull"`
+	// Label names the channel where the link is published, e.g. "site" or "conference"
+	Label     string    `bun:"Label,notnull"`
+	ExpiresAt time.Time `bun:"ExpiresAt,nullzero"` // zero for links without expiry
+	MaxUses   int64     `bun:"MaxUses,notnull"`    // 0 for unlimited
+	Revoked   bool      `bun:"Revoked,notnull"`
+}
+
+// Expired reports whether the link can't be used at t because of its expiry time.
+func (l InviteLink) Expired(t time.Time) bool {
+	return !l.ExpiresAt.IsZero() && t.After(l.ExpiresAt)
+}
+
+// InviteUse is recipient's join by an invite link, repeated joins by the same link aren't recorded.
+type InviteUse struct {
+	bun.BaseModel `bun:"table:InviteUses,alias:inviteUse"`
+
+	Token       string `bun:"Token,pk"`
+	RecipientId int64  `bun:"RecipientId,pk"`
+	ListId      int64  `bun:"ListId,notnull"`
+	// NewRecipient is true if the recipient started the bot by this link
+	NewRecipient bool      `bun:"NewRecipient,notnull"`
+	UsedAt       time.Time `bun:"UsedAt,notnull"`
+}
+
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleEditor = "editor"
+	OrgRoleViewer = "viewer"
+)
+
+// Organization shares topics, lists, broadcasts and replies between its members.
+// SenderTGId columns of other tables hold OrgId. Organizations of senders who had data before organizations
+// were introduced have OrgId equal to the sender's telegram id, new ones get the next id, ids of deleted ones aren't reused.
+type Organization struct {
+	bun.BaseModel `bun:"table:Organizations,alias:organization"`
+
+	OrgId     int64     `bun:"OrgId,pk,autoincrement"`
+	Name      string    `bun:"Name,notnull"`
+	CreatedAt time.Time `bun:"CreatedAt,notnull"`
+}
+
+// OrgMember is a user of an organization, every user can be a member of one organization.
+type OrgMember struct {
+	bun.BaseModel `bun:"table:OrgMembers,alias:orgMember"`
+
+	OrgId    int64     `bun:"OrgId,pk"`
+	UserTGId int64     `bun:"UserTGId,pk"`
+	Role     string    `bun:"Role,notnull"`
+	Name     string    `bun:"Name,notnull"`
+	Username string    `bun:"Username,notnull"`
+	JoinedAt time.Time `bun:"JoinedAt,notnull"`
+}
+
+// OrgInvite is a one-time token of deep link t.me/<bot>?start=<token> that adds a teammate to the organization.
+type OrgInvite struct {
+	bun.BaseModel `bun:"table:OrgInvites,alias:orgInvite"`
+
+	Token     string    `bun:"Token,pk"`
+	OrgId     int64     `bun:"OrgId,notnull"`
+	Role      string    `bun:"Role,notnull"`
+	CreatedBy int64     `bun:"CreatedBy,notnull"`
+	CreatedAt time.Time `bun:"CreatedAt,notnull"`
+	ExpiresAt time.Time `bun:"ExpiresAt,notnull"`
+	UsedBy    int64     `bun:"UsedBy,notnull"` // 0 while not used
+}
+
+// MessageCopy is a message forwarded to one of organization members' chats,
+// it maps a reply to that chat message back to the stored message.
+type MessageCopy struct {
+	bun.BaseModel `bun:"table:MessageCopies,alias:messageCopy"`
+
+	ChatId      int64 `bun:"ChatId,pk"`
+	MessageTGId int64 `bun:"MessageTGId,pk"`
+	MessageId   int64 `bun:"MessageId,notnull"`
+}
+
+// CallbackState keeps parameters of an inline keyboard that don't fit into callback data,
+// buttons refer to it by Token.
+type CallbackState struct {
+	bun.BaseModel `bun:"table:CallbackStates,alias:callbackState"`
+
+	Token     string    `bun:"Token,pk"`
+	ChatId    int64     `bun:"ChatId,notnull"`
+	Data      string    `bun:"Data,notnull"` // json, depends on keyboard
+	UpdatedAt time.Time `bun:"UpdatedAt,notnull"`
+}
+
+// PagedMessage is a message of /show_replies paging that currently shows the stored reply,
+// replying to it answers the reply's author.
+type PagedMessage struct {
+	bun.BaseModel `bun:"table:PagedMessages,alias:pagedMessage"`
+
+	ChatId      int64     `bun:"ChatId,pk"`
+	MessageTGId int64     `bun:"MessageTGId,pk"`
+	MessageId   int64     `bun:"MessageId,notnull"`
+	ShownAt     time.Time `bun:"ShownAt,notnull"`
+}
+
+// BotState keeps values that must survive restarts, e.g. long polling offset.
+type BotState struct {
+	bun.BaseModel `bun:"table:BotState,alias:botState"`
+
+	Key   string `bun:"Key,pk"`
+	Value int64  `bun:"Value,notnull"`
+}
+
+// MessageMediaPoll is models.Message.MediaType of delivered polls.
+const MessageMediaPoll = "poll"
+
+// Poll is a native telegram poll or quiz broadcast to a mailing list.
+// Every recipient gets their own copy of the poll, copies are mapped back by PollMessage.
+type Poll struct {
+	bun.BaseModel `bun:"table:Polls,alias:poll"`
+
+	PollId          int64     `bun:"PollId,pk,autoincrement,unique"`
+	SenderTGId      int64     `bun:"SenderTGId,notnull"`
+	TopicId         int64     `bun:"TopicId,notnull"`
+	ListId          int64     `bun:"ListId,notnull"`
+	Question        string    `bun:"Question,notnull"`
+	Options         []string  `bun:"Options,notnull"`       // json
+	Quiz            bool      `bun:"Quiz,notnull"`          // quiz has exactly one correct option
+	CorrectOption   int       `bun:"CorrectOption,notnull"` // index in Options, quiz only
+	MultipleAnswers bool      `bun:"MultipleAnswers,notnull"`
+	CreatedAt       time.Time `bun:"CreatedAt,notnull"`
+}
+
+// PollMessage is a copy of the poll delivered to one recipient.
+type PollMessage struct {
+	bun.BaseModel `bun:"table:PollMessages,alias:pollMessage"`
+
+	TGPollId    string `bun:"TGPollId,pk"`
+	PollId      int64  `bun:"PollId,notnull"`
+	RecipientId int64  `bun:"RecipientId,notnull"`
+	MessageTGId int64  `bun:"MessageTGId,notnull"`
+}
+
+// PollAnswer is the recipient's current vote, it's deleted when the vote is retracted.
+type PollAnswer struct {
+	bun.BaseModel `bun:"table:PollAnswers,alias:pollAnswer"`
+
+	PollId      int64     `bun:"PollId,pk"`
+	RecipientId int64     `bun:"RecipientId,pk"`
+	Options     []int     `bun:"Options,notnull"` // json, indexes in Poll.Options
+	AnsweredAt  time.Time `bun:"AnsweredAt,notnull"`
+}
+
+// RecipientField is a custom personalization variable of the recipient, imported by the organization with a mailing list.
+type RecipientField struct {
+	bun.BaseModel `bun:"table:RecipientFields,alias:recipientField"`
+
+	SenderTGId  int64  `bun:"SenderTGId,pk"`
+	RecipientId int64  `bun:"RecipientId,pk"`
+	Name        string `bun:"Name,pk"`
+	Value       string `bun:"Value,notnull"`
+}
+
+// MessageTemplate is a named broadcast text saved for reuse across topics.
+type MessageTemplate struct {
+	bun.BaseModel `bun:"table:Templates,alias:template"`
+
+	TemplateId int64     `bun:"TemplateId,pk,autoincrement,unique"`
+	SenderTGId int64     `bun:"SenderTGId,notnull"`
+	Name       string    `bun:"Name,notnull"`
+	Text       string    `bun:"Text,notnull"`
+	UpdatedAt  time.Time `bun:"UpdatedAt,notnull"`
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+// command: /notifications_config [quiet <from_hour> <to_hour> | quiet off]
+func (b *Bot) handleNotificationsConfig(ctx telebot.Context) error {
+	senderTGId := senderOrgId(ctx)
+	settings, err := b.db.GetSenderSettings(senderTGId)
+	if err != nil {
+		return err
+	}
+
+	args := ctx.Args()
+	if len(args) > 0 {
+		if args[0] != "quiet" {
+			return ctx.Send("Пожалуйста, введите данные в формате /notifications_config quiet <с_часа> <до_часа> или /notifications_config quiet off")
+		}
+		switch {
+		case len(args) == 2 && args[1] == "off":
+			settings.QuietHoursEnabled = false
+		case len(args) == 3:
+			from, errFrom := strconv.ParseInt(args[1], 10, 64)
+			to, errTo := strconv.ParseInt(args[2], 10, 64)
+			if errFrom != nil || errTo != nil || from < 0 || from > 23 || to < 0 || to > 23 {
+				return ctx.Send("Часы должны быть числами от 0 до 23")
+			}
+			settings.QuietHoursEnabled = true
+			settings.QuietHoursFrom = from
+			settings.QuietHoursTo = to
+		default:
+			return ctx.Send("Пожалуйста, введите данные в формате /notifications_config quiet <с_часа> <до_часа> или /notifications_config quiet off")
+		}
+		err = b.db.SaveSenderSettings(settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = b.client.Send(ctx.Recipient(), formatSenderSettings(settings), notificationsMarkup())
+	return err
+}
+
+// notifications config buttons data
+const (
+	notificationsOn        = "on"
+	notificationsOff       = "off"
+	notificationsDigestOn  = "digest_on"
+	notificationsDigestOff = "digest_off"
+)
+
+func notificationsMarkup() *telebot.ReplyMarkup {
+	var replyMarkup = &telebot.ReplyMarkup{}
+	var btnOn = replyMarkup.Data("Включить", btnNotifications.Unique, notificationsOn)
+	var btnOff = replyMarkup.Data("Отключить", btnNotifications.Unique, notificationsOff)
+	var btnDigestOn = replyMarkup.Data("Дайджест", btnNotifications.Unique, notificationsDigestOn)
+	var btnDigestOff = replyMarkup.Data("Каждый ответ", btnNotifications.Unique, notificationsDigestOff)
+	replyMarkup.Inline(replyMarkup.Row(btnOn, btnOff), replyMarkup.Row(btnDigestOn, btnDigestOff))
+	return replyMarkup
+}
+
+func (b *Bot) handleNotificationsButton(ctx telebot.Context) error {
+	settings, err := b.db.GetSenderSettings(senderOrgId(ctx))
+	if err != nil {
+		return err
+	}
+
+	switch ctx.Callback().Data {
+	case notificationsOn:
+		settings.NotificationsEnabled = true
+	case notificationsOff:
+		settings.NotificationsEnabled = false
+	case notificationsDigestOn:
+		if !settings.DigestMode {
+			// digest starts from now, older replies were already forwarded
+			lastMessageId, err := b.db.GetLastMessageId()
+			if err != nil {
+				return err
+			}
+			settings.DigestMode = true
+			settings.LastDigestMessageId = lastMessageId
+		}
+	case notificationsDigestOff:
+		settings.DigestMode = false
+	default:
+		return b.handleExpiredCallback(ctx)
+	}
+
+	err = b.db.SaveSenderSettings(settings)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Edit(ctx.Message(), formatSenderSettings(settings), notificationsMarkup())
+	if err != nil && !isNotModified(err) {
+		return err
+	}
+	return ctx.Respond()
+}
+
+func formatSenderSettings(settings models.SenderSettings) string {
+	onOff := func(v bool) string {
+		if v {
+			return "включены"
+		}
+		return "отключены"
+	}
+
+	str := new(strings.Builder)
+	str.WriteString("Настройки уведомлений:")
+	_, _ = fmt.Fprintf(str, "\nУведомления об ответах: %s", onOff(settings.NotificationsEnabled))
+	if settings.DigestMode {
+		str.WriteString("\nРежим: дайджест")
+	} else {
+		str.WriteString("\nРежим: каждый ответ сразу")
+	}
+	if settings.QuietHoursEnabled {
+		_, _ = fmt.Fprintf(str, "\nТихие часы: с %02d:00 до %02d:00", settings.QuietHoursFrom, settings.QuietHoursTo)
+	} else {
+		str.WriteString("\nТихие часы: отключены")
+	}
+	return str.String()
+}
+
+func (b *Bot) runDigests() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.cfg.DigestInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			err := b.sendDigests()
+			if err != nil {
+				log.Errorf("send digests: %v", err)
+			}
+		}
+	}
+}
+
+func (b *Bot) sendDigests() error {
+	senders, err := b.db.GetDigestModeSenders()
+	if err != nil {
+		return err
+	}
+
+	for _, settings := range senders {
+		if !settings.NotificationsEnabled {
+			continue
+		}
+		messages, err := b.db.GetRecipientMessagesAfter(settings.SenderTGId, settings.LastDigestMessageId)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		topicsCount := make(map[int64]int)
+		for _, msg := range messages {
+			topicsCount[msg.TopicId]++
+		}
+		lines := make([]string, 0, len(topicsCount))
+		for topicId, count := range topicsCount {
+			topic, err := b.db.GetUserTopicById(topicId)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%s: %d", topic.Topic, count))
+		}
+		sort.Strings(lines)
+
+		str := fmt.Sprintf("Новых ответов: %d\n\n%s", len(messages), strings.Join(lines, "\n"))
+		opts := &telebot.SendOptions{DisableNotification: settings.InQuietHours(time.Now())}
+		sent, err := b.sendToOrganization(settings.SenderTGId, func(to telebot.Recipient) (*telebot.Message, error) {
+			return b.client.Send(to, str, opts)
+		})
+		if err != nil {
+			log.Errorf("send digest to %d: %v", settings.SenderTGId, err)
+			continue
+		}
+		if len(sent) == 0 {
+			log.Errorf("send digest to %d: no organization member received the digest", settings.SenderTGId)
+			continue
+		}
+
+		settings.LastDigestMessageId = messages[len(messages)-1].MessageId
+		err = b.db.SaveSenderSettings(settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+const (
+	orgMemberKey = "org_member"
+	orgInviteTTL = 7 * 24 * time.Hour
+
+	lastOwnerText = "В организации должен остаться хотя бы один владелец, сначала назначьте другого: /org_role <участник> owner"
+)
+
+var orgRoleLevels = map[string]int{
+	models.OrgRoleViewer: 1,
+	models.OrgRoleEditor: 2,
+	models.OrgRoleOwner:  3,
+}
+
+func (b *Bot) initOrgHandlers(viewers, owners *telebot.Group) {
+	b.client.Handle("/org_create", b.handleOrgCreate, IgnoreNonPrivateMessages)
+	viewers.Handle("/org", b.handleOrg)
+	viewers.Handle("/org_leave", b.handleOrgLeave)
+	owners.Handle("/org_invite", b.handleOrgInvite)
+	owners.Handle("/org_role", b.handleOrgRole)
+	owners.Handle("/org_remove", b.handleOrgRemove)
+}
+
+// RequireRole allows the handler only for organization members with at least the given role,
+// others get a denial message.
+func (b *Bot) RequireRole(role string) telebot.MiddlewareFunc {
+	return func(next telebot.HandlerFunc) telebot.HandlerFunc {
+		return func(ctx telebot.Context) error {
+			member, ok, err := b.orgMember(ctx)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				if b.canCreateOrg(ctx.Sender().ID) {
+					return denyAccess(ctx, "Вы не состоите в организации. Создайте свою командой /org_create <название> "+
+						"или попросите владельца организации прислать вам приглашение")
+				}
+				return denyAccess(ctx, "Эта команда доступна только отправителям рассылок. Попросите владельца организации прислать вам приглашение")
+			}
+			if orgRoleLevels[member.Role] < orgRoleLevels[role] {
+				return denyAccess(ctx, fmt.Sprintf("Недостаточно прав: нужна роль %s, ваша роль %s", role, member.Role))
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func denyAccess(ctx telebot.Context, text string) error {
+	if ctx.Callback() != nil {
+		return ctx.Respond(&telebot.CallbackResponse{Text: text, ShowAlert: true})
+	}
+	return ctx.Send(text)
+}
+
+// orgMember returns organization membership of the update sender and keeps it in the context.
+func (b *Bot) orgMember(ctx telebot.Context) (models.OrgMember, bool, error) {
+	if member, ok := ctx.Get(orgMemberKey).(models.OrgMember); ok {
+		return member, true, nil
+	}
+	if ctx.Sender() == nil {
+		return models.OrgMember{}, false, nil
+	}
+	member, err := b.db.GetOrgMemberByUser(ctx.Sender().ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.OrgMember{}, false, nil
+	}
+	if err != nil {
+		return models.OrgMember{}, false, err
+	}
+	ctx.Set(orgMemberKey, member)
+	return member, true, nil
+}
+
+// senderOrgId returns organization of the update sender, it's used instead of chat id as SenderTGId of shared data.
+// It's set only for handlers behind RequireRole or after orgMember call.
+func senderOrgId(ctx telebot.Context) int64 {
+	member, _ := ctx.Get(orgMemberKey).(models.OrgMember)
+	return member.OrgId
+}
+
+// canCreateOrg reports whether user may create an organization, AdminIDs limits who can do it.
+func (b *Bot) canCreateOrg(userTGId int64) bool {
+	if len(b.cfg.AdminIDs) == 0 {
+		return true
+	}
+	for _, id := range b.cfg.AdminIDs {
+		if id == userTGId {
+			return true
+		}
+	}
+	return false
+}
+
+// command: /org_create <name>
+func (b *Bot) handleOrgCreate(ctx telebot.Context) error {
+	name := commandTail(ctx.Message().Text, 0)
+	if name == "" {
+		return ctx.Send("Пожалуйста, введите данные в формате /org_create <Название_организации>")
+	}
+	if !b.canCreateOrg(ctx.Sender().ID) {
+		return ctx.Send("Вы не можете создать организацию. Попросите владельца организации прислать вам приглашение")
+	}
+	member, ok, err := b.orgMember(ctx)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return ctx.Send(fmt.Sprintf("Вы уже состоите в организации #%d. Чтобы создать новую, покиньте ее командой /org_leave", member.OrgId))
+	}
+
+	now := time.Now()
+	_, err = b.db.AddOrganization(models.Organization{Name: name, CreatedAt: now}, models.OrgMember{
+		UserTGId: ctx.Sender().ID,
+		Role:     models.OrgRoleOwner,
+		Name:     userFullName(ctx.Sender()),
+		Username: ctx.Sender().Username,
+		JoinedAt: now,
+	})
+	if err != nil {
+		log.Errorf("create organization: %v", err)
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Организация '%s' создана, вы ее владелец. Пригласить коллег: /org_invite [editor|viewer|owner]", name))
+}
+
+// command: /org
+func (b *Bot) handleOrg(ctx telebot.Context) error {
+	member, _, err := b.orgMember(ctx)
+	if err != nil {
+		return err
+	}
+	org, err := b.db.GetOrganizationById(member.OrgId)
+	if err != nil {
+		return err
+	}
+	members, err := b.db.GetOrgMembers(member.OrgId)
+	if err != nil {
+		return err
+	}
+
+	str := new(strings.Builder)
+	_, _ = fmt.Fprintf(str, "Организация '%s', ваша роль: %s\n\nУчастники:", org.Name, member.Role)
+	for _, m := range members {
+		_, _ = fmt.Fprintf(str, "\n%s - %s", orgMemberTitle(m), m.Role)
+	}
+	if member.Role == models.OrgRoleOwner {
+		str.WriteString("\n\nПригласить: /org_invite [editor|viewer|owner]\nИзменить роль: /org_role <участник> <роль>\nУдалить: /org_remove <участник>")
+	}
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
+
+// command: /org_invite [role]
+func (b *Bot) handleOrgInvite(ctx telebot.Context) error {
+	args := ctx.Args()
+	role := models.OrgRoleEditor
+	if len(args) > 0 {
+		role = args[0]
+	}
+	if _, ok := orgRoleLevels[role]; !ok || len(args) > 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /org_invite [editor|viewer|owner]\n" +
+			"viewer - просмотр списков, ответов и статистики\neditor - еще и рассылки, списки и ответы получателям\nowner - еще и управление участниками")
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = b.db.AddOrgInvite(models.OrgInvite{
+		Token:     token,
+		OrgId:     senderOrgId(ctx),
+		Role:      role,
+		CreatedBy: ctx.Sender().ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(orgInviteTTL),
+	})
+	if err != nil {
+		log.Errorf("organization invite: %v", err)
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Одноразовая ссылка для приглашения коллеги с ролью %s, действует до %s:\n%s",
+		role, now.Add(orgInviteTTL).Format(scheduleTimeLayout), b.inviteURL(token)))
+}
+
+// command: /org_role <member> <role>
+func (b *Bot) handleOrgRole(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 2 {
+		return ctx.Send("Пожалуйста, введите данные в формате /org_role <@username|id> <editor|viewer|owner>")
+	}
+	role := args[1]
+	if _, ok := orgRoleLevels[role]; !ok {
+		return ctx.Send("Роль должна быть одной из: owner, editor, viewer")
+	}
+	member, ok, err := b.findOrgMember(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	ok, err = b.db.SetOrgMemberRole(member.OrgId, member.UserTGId, role)
+	if err != nil {
+		log.Errorf("set organization role: %v", err)
+		return err
+	}
+	if !ok {
+		return ctx.Send(lastOwnerText)
+	}
+	_, _ = b.client.Send(telebot.ChatID(member.UserTGId), fmt.Sprintf("Ваша роль в организации изменена на %s", role))
+	return ctx.Send(fmt.Sprintf("Роль %s изменена на %s", orgMemberTitle(member), role))
+}
+
+// command: /org_remove <member>
+func (b *Bot) handleOrgRemove(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /org_remove <@username|id>")
+	}
+	member, ok, err := b.findOrgMember(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+
+	ok, err = b.db.DeleteOrgMember(member.OrgId, member.UserTGId)
+	if err != nil {
+		log.Errorf("remove organization member: %v", err)
+		return err
+	}
+	if !ok {
+		return ctx.Send(lastOwnerText)
+	}
+	_, _ = b.client.Send(telebot.ChatID(member.UserTGId), "Вы удалены из организации")
+	return ctx.Send(fmt.Sprintf("%s удален из организации", orgMemberTitle(member)))
+}
+
+// command: /org_leave
+// the last member deletes the organization
+func (b *Bot) handleOrgLeave(ctx telebot.Context) error {
+	member, _, err := b.orgMember(ctx)
+	if err != nil {
+		return err
+	}
+
+	ok, err := b.db.DeleteOrgMember(member.OrgId, member.UserTGId)
+	if err != nil {
+		log.Errorf("leave organization: %v", err)
+		return err
+	}
+	if !ok {
+		return ctx.Send(lastOwnerText)
+	}
+	_, err = b.db.GetOrganizationById(member.OrgId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ctx.Send("Вы были последним участником, организация удалена, запланированные рассылки отменены. Создать новую: /org_create <название>")
+	}
+	if err != nil {
+		return err
+	}
+	b.notifyOrganization(member.OrgId, fmt.Sprintf("%s покинул организацию", orgMemberTitle(member)))
+	return ctx.Send("Вы покинули организацию")
+}
+
+// joinOrganization adds the user to organization of invite token from /start payload.
+func (b *Bot) joinOrganization(ctx telebot.Context, invite models.OrgInvite) error {
+	if invite.UsedBy != 0 {
+		return ctx.Send("Это приглашение уже использовано, попросите новое")
+	}
+	if time.Now().After(invite.ExpiresAt) {
+		return ctx.Send("Срок действия приглашения истек, попросите новое")
+	}
+	current, ok, err := b.orgMember(ctx)
+	if err != nil {
+		return err
+	}
+	if ok && current.OrgId == invite.OrgId {
+		return ctx.Send("Вы уже состоите в этой организации")
+	}
+	if ok {
+		return ctx.Send("Вы уже состоите в другой организации. Покиньте ее командой /org_leave и откройте приглашение снова")
+	}
+
+	member := models.OrgMember{
+		OrgId:    invite.OrgId,
+		UserTGId: ctx.Sender().ID,
+		Role:     invite.Role,
+		Name:     userFullName(ctx.Sender()),
+		Username: ctx.Sender().Username,
+		JoinedAt: time.Now(),
+	}
+	used, err := b.db.UseOrgInvite(invite.Token, member)
+	if err != nil {
+		log.Errorf("join organization: %v", err)
+		return err
+	}
+	if !used {
+		return ctx.Send("Это приглашение уже использовано, попросите новое")
+	}
+	org, err := b.db.GetOrganizationById(invite.OrgId)
+	if err != nil {
+		return err
+	}
+
+	b.notifyOrganization(invite.OrgId, fmt.Sprintf("%s присоединился к организации с ролью %s", orgMemberTitle(member), member.Role))
+	return ctx.Send(fmt.Sprintf("Вы присоединились к организации '%s' с ролью %s. Подробнее: /org", org.Name, member.Role))
+}
+
+// findOrgMember looks up a member of sender's organization by @username or telegram id. If ok is false, user is already notified.
+func (b *Bot) findOrgMember(ctx telebot.Context, nameOrId string) (models.OrgMember, bool, error) {
+	members, err := b.db.GetOrgMembers(senderOrgId(ctx))
+	if err != nil {
+		return models.OrgMember{}, false, err
+	}
+	tgId, _ := strconv.ParseInt(nameOrId, 10, 64)
+	username := strings.TrimPrefix(nameOrId, "@")
+	for _, member := range members {
+		if member.UserTGId == tgId || (member.Username != "" && strings.EqualFold(member.Username, username)) {
+			return member, true, nil
+		}
+	}
+	return models.OrgMember{}, false, ctx.Send(fmt.Sprintf("Участник '%s' не найден, участники организации: /org", nameOrId))
+}
+
+// sendToOrganization sends to every organization member and returns messages that were sent.
+func (b *Bot) sendToOrganization(orgId int64, send func(to telebot.Recipient) (*telebot.Message, error)) ([]*telebot.Message, error) {
+	members, err := b.db.GetOrgMembers(orgId)
+	if err != nil {
+		return nil, err
+	}
+	sent := make([]*telebot.Message, 0, len(members))
+	for _, member := range members {
+		message, err := send(telebot.ChatID(member.UserTGId))
+		if err != nil {
+			log.Warnf("send to organization %d member %d: %v", orgId, member.UserTGId, err)
+			continue
+		}
+		sent = append(sent, message)
+	}
+	return sent, nil
+}
+
+func (b *Bot) notifyOrganization(orgId int64, text string, opts ...interface{}) {
+	_, err := b.sendToOrganization(orgId, func(to telebot.Recipient) (*telebot.Message, error) {
+		return b.client.Send(to, text, opts...)
+	})
+	if err != nil {
+		log.Errorf("notify organization %d: %v", orgId, err)
+	}
+}
+
+func orgMemberTitle(member models.OrgMember) string {
+	if member.Username == "" {
+		return fmt.Sprintf("%s (id %d)", member.Name, member.UserTGId)
+	}
+	return fmt.Sprintf("@%s (%s)", member.Username, member.Name)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pymq/tfahack/db"
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+// telegram limits for sendPoll
+const (
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 100
+	minPollOptions        = 2
+	maxPollOptions        = 10
+)
+
+var btnPollResults = &telebot.Btn{Unique: "poll_results"}
+
+func (b *Bot) initPollHandlers(viewers, editors *telebot.Group) {
+	editors.Handle("/send_poll", b.handleSendPoll)
+	viewers.Handle("/poll_results", b.handlePollResults)
+	viewers.Handle("/poll_export", b.handlePollExport)
+	viewers.Handle(btnPollResults, b.handlePollResultsButton)
+	b.client.Handle(telebot.OnPollAnswer, b.handlePollAnswer)
+}
+
+// command: /send_poll <topic> <mailing_list> [quiz=<n>|multi]
+// followed by the question and options, one per line
+func (b *Bot) handleSendPoll(ctx telebot.Context) error {
+	const usage = "Пожалуйста, введите данные в формате:\n/send_poll <IdТопика> <Список> [quiz=<номер_верного_ответа>|multi]\nВопрос\nВариант 1\nВариант 2\n...\n\n" +
+		"quiz - викторина с одним верным ответом, multi - можно выбрать несколько вариантов"
+	lines := strings.Split(ctx.Message().Text, "\n")
+	args := strings.Fields(lines[0])[1:]
+	var question string
+	var options []string
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case question == "":
+			question = line
+		default:
+			options = append(options, line)
+		}
+	}
+	if len(args) < 2 || len(args) > 3 || question == "" || len(options) < minPollOptions {
+		return ctx.Send(usage)
+	}
+	if len(options) > maxPollOptions {
+		return ctx.Send(fmt.Sprintf("В опросе может быть не больше %d вариантов", maxPollOptions))
+	}
+	if utf8.RuneCountInString(question) > maxPollQuestionLength {
+		return ctx.Send(fmt.Sprintf("Вопрос должен быть не длиннее %d символов", maxPollQuestionLength))
+	}
+	for _, option := range options {
+		if utf8.RuneCountInString(option) > maxPollOptionLength {
+			return ctx.Send(fmt.Sprintf("Вариант ответа должен быть не длиннее %d символов: %s", maxPollOptionLength, option))
+		}
+	}
+
+	poll := models.Poll{
+		SenderTGId: senderOrgId(ctx),
+		Question:   question,
+		Options:    options,
+		CreatedAt:  time.Now(),
+	}
+	if len(args) == 3 {
+		switch {
+		case args[2] == "multi":
+			poll.MultipleAnswers = true
+		case strings.HasPrefix(args[2], "quiz="):
+			n, err := strconv.Atoi(strings.TrimPrefix(args[2], "quiz="))
+			if err != nil || n < 1 || n > len(options) {
+				return ctx.Send(fmt.Sprintf("Номер верного ответа должен быть от 1 до %d", len(options)))
+			}
+			poll.Quiz = true
+			poll.CorrectOption = n - 1
+		default:
+			return ctx.Send(usage)
+		}
+	}
+
+	list, ok, err := b.findMailingList(ctx, args[1])
+	if err != nil || !ok {
+		return err
+	}
+	topic, err := b.getOrAddTopic(senderOrgId(ctx), args[0])
+	if err != nil {
+		log.Errorf("send poll: create topic: %v", err)
+		return err
+	}
+	poll.ListId = list.ListId
+	poll.TopicId = topic.TopicId
+
+	broadcast, err := b.broadcastPoll(poll)
+	if err != nil {
+		log.Errorf("send poll: %v", err)
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Опрос поставлен в очередь как рассылка #%d, отчет о доставке придет по завершении.\nРезультаты: /poll_results %s",
+		broadcast.BroadcastId, topic.Topic))
+}
+
+// telegramPoll is the poll to send, it's not anonymous so that the bot gets PollAnswer updates.
+func telegramPoll(poll models.Poll) *telebot.Poll {
+	tgPoll := &telebot.Poll{
+		Type:            telebot.PollRegular,
+		Question:        poll.Question,
+		MultipleAnswers: poll.MultipleAnswers,
+		Anonymous:       false,
+	}
+	if poll.Quiz {
+		tgPoll.Type = telebot.PollQuiz
+		tgPoll.CorrectOption = poll.CorrectOption
+	}
+	for _, option := range poll.Options {
+		tgPoll.Options = append(tgPoll.Options, telebot.PollOption{Text: option})
+	}
+	return tgPoll
+}
+
+func (b *Bot) handlePollAnswer(ctx telebot.Context) error {
+	answer := ctx.PollAnswer()
+	pollMessage, err := b.db.GetPollMessage(answer.PollID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	recipients, err := b.db.GetRecipientsByIds([]int64{answer.Sender.ID})
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 || recipients[0].RecipientId != pollMessage.RecipientId {
+		log.Warnf("poll answer: user %d is not the recipient of poll %s", answer.Sender.ID, answer.PollID)
+		return nil
+	}
+
+	// empty options mean the vote is retracted
+	if len(answer.Options) == 0 {
+		err = b.db.DeletePollAnswer(pollMessage.PollId, pollMessage.RecipientId)
+	} else {
+		err = b.db.SavePollAnswer(models.PollAnswer{
+			PollId:      pollMessage.PollId,
+			RecipientId: pollMessage.RecipientId,
+			Options:     answer.Options,
+			AnsweredAt:  time.Now(),
+		})
+	}
+	if err != nil {
+		log.Errorf("save poll answer: %v", err)
+		return err
+	}
+
+	message, err := b.db.GetSentMessage(recipients[0], pollMessage.MessageTGId)
+	if err == nil && message.Read == 0 {
+		err = b.db.MarkMessageRead(message.MessageId)
+	}
+	if err != nil {
+		log.Errorf("poll answer: mark message read: %v", err)
+	}
+	return nil
+}
+
+// command: /poll_results <topic>
+func (b *Bot) handlePollResults(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /poll_results <IdТопика>")
+	}
+	topic, ok, err := b.findTopic(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+	str, polls, err := b.formatPollResults(topic)
+	if err != nil {
+		return err
+	}
+	if polls == 0 {
+		return ctx.Send(str)
+	}
+	return ctx.Send(str, pollResultsMarkup(topic.TopicId))
+}
+
+// callback data: <topic_id>
+func (b *Bot) handlePollResultsButton(ctx telebot.Context) error {
+	topicId, err := strconv.ParseInt(ctx.Callback().Data, 10, 64)
+	if err != nil {
+		log.Errorf("invalid data in inline keyboard callback: '%s'", ctx.Callback().Data)
+		return b.handleExpiredCallback(ctx)
+	}
+	topic, err := b.db.GetUserTopicById(topicId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && topic.SenderTGId != senderOrgId(ctx)) {
+		return b.handleExpiredCallback(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	str, _, err := b.formatPollResults(topic)
+	if err != nil {
+		return err
+	}
+	err = ctx.Edit(str, pollResultsMarkup(topic.TopicId))
+	if isNotModified(err) {
+		return ctx.Respond(&telebot.CallbackResponse{Text: "Новых ответов нет"})
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Respond(&telebot.CallbackResponse{Text: "Обновлено"})
+}
+
+func pollResultsMarkup(topicId int64) *telebot.ReplyMarkup {
+	var replyMarkup = &telebot.ReplyMarkup{}
+	replyMarkup.Inline(replyMarkup.Row(replyMarkup.Data("Обновить", btnPollResults.Unique, strconv.FormatInt(topicId, 10))))
+	return replyMarkup
+}
+
+// formatPollResults returns results summary of all topic polls and the number of polls.
+func (b *Bot) formatPollResults(topic models.Topic) (string, int, error) {
+	polls, err := b.db.GetPollsByTopicId(topic.TopicId)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(polls) == 0 {
+		return fmt.Sprintf("По топику '%s' не было опросов. Отправить опрос: /send_poll", topic.Topic), 0, nil
+	}
+
+	str := new(strings.Builder)
+	_, _ = fmt.Fprintf(str, "Результаты опросов по топику '%s':", topic.Topic)
+	for _, poll := range polls {
+		results, err := b.db.GetPollResults(poll.PollId)
+		if err != nil {
+			return "", 0, err
+		}
+		kind := "опрос"
+		switch {
+		case poll.Quiz:
+			kind = "викторина"
+		case poll.MultipleAnswers:
+			kind = "опрос, несколько ответов"
+		}
+		_, _ = fmt.Fprintf(str, "\n\n%s (%s)\nполучили %d; ответили %d (%d%%)",
+			poll.Question, kind, results.Delivered, results.Answered, percent(results.Answered, results.Delivered))
+		for i, option := range poll.Options {
+			mark := "•"
+			if poll.Quiz && i == poll.CorrectOption {
+				mark = "✓"
+			}
+			votes := results.Votes[i]
+			_, _ = fmt.Fprintf(str, "\n%s %s - %d (%d%%)", mark, option, votes, percent(votes, results.Answered))
+		}
+	}
+	_, _ = fmt.Fprintf(str, "\n\nОтветы по получателям: /poll_export %s", topic.Topic)
+	return str.String(), len(polls), nil
+}
+
+// command: /poll_export <topic>
+func (b *Bot) handlePollExport(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /poll_export <IdТопика>")
+	}
+	topic, ok, err := b.findTopic(ctx, args[0])
+	if err != nil || !ok {
+		return err
+	}
+	polls, err := b.db.GetPollsByTopicId(topic.TopicId)
+	if err != nil {
+		return err
+	}
+	if len(polls) == 0 {
+		return ctx.Send(fmt.Sprintf("По топику '%s' не было опросов", topic.Topic))
+	}
+
+	buf := new(bytes.Buffer)
+	writer := csv.NewWriter(buf)
+	err = writer.Write([]string{"poll_id", "question", "username", "tg_id", "name", "answer", "correct", "answered_at"})
+	if err != nil {
+		return err
+	}
+	for _, poll := range polls {
+		rows, err := b.db.GetPollAnswerRows(poll.PollId)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			err = writer.Write(pollAnswerRecord(poll, row))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		return err
+	}
+
+	return ctx.Send(&telebot.Document{
+		File:     telebot.FromReader(bytes.NewReader(buf.Bytes())),
+		FileName: fmt.Sprintf("%s_polls.csv", topic.Topic),
+		Caption:  fmt.Sprintf("Ответы на опросы по топику '%s', опросов: %d", topic.Topic, len(polls)),
+	})
+}
+
+// pollAnswerRecord is a csv row of /poll_export, answer is empty if the recipient didn't vote.
+func pollAnswerRecord(poll models.Poll, row db.PollAnswerRow) []string {
+	answers := make([]string, 0, len(row.Options))
+	for _, option := range row.Options {
+		if option >= 0 && option < len(poll.Options) {
+			answers = append(answers, poll.Options[option])
+		}
+	}
+	var correct, answeredAt string
+	if len(row.Options) > 0 {
+		if poll.Quiz {
+			correct = strconv.FormatBool(len(row.Options) == 1 && row.Options[0] == poll.CorrectOption)
+		}
+		answeredAt = row.AnsweredAt.Local().Format(time.RFC3339)
+	}
+	return []string{
+		strconv.FormatInt(poll.PollId, 10),
+		poll.Question,
+		row.RecipientTGName,
+		strconv.FormatInt(row.RecipientTGId, 10),
+		row.RecipientName,
+		strings.Join(answers, "; "),
+		correct,
+		answeredAt,
+	}
+}
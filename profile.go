@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+// maxKnownProfiles bounds the profiles cache, it's cleared when full and refilled by next updates
+const maxKnownProfiles = 10000
+
+// SyncRecipientProfile updates name and username of a known recipient on any update from them.
+func (b *Bot) SyncRecipientProfile(next telebot.HandlerFunc) telebot.HandlerFunc {
+	return func(ctx telebot.Context) error {
+		if user := ctx.Sender(); user != nil && !user.IsBot {
+			err := b.syncRecipientProfile(user)
+			if err != nil {
+				log.Errorf("sync recipient profile: %v", err)
+			}
+		}
+		return next(ctx)
+	}
+}
+
+func (b *Bot) syncRecipientProfile(user *telebot.User) error {
+	name := userFullName(user)
+	profile := fmt.Sprintf("%s\x00%s", name, user.Username)
+	b.knownProfilesLock.Lock()
+	known := b.knownProfiles[user.ID] == profile
+	b.knownProfilesLock.Unlock()
+	if known {
+		return nil
+	}
+
+	recipients, err := b.db.GetRecipientsByIds([]int64{user.ID})
+	if err != nil {
+		return err
+	}
+	if len(recipients) > 0 {
+		recipient := recipients[0]
+		if recipient.RecipientName != name || recipient.RecipientTGName != user.Username {
+			err = b.db.UpdateRecipientProfile(recipient, name, user.Username)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	b.knownProfilesLock.Lock()
+	if len(b.knownProfiles) >= maxKnownProfiles {
+		b.knownProfiles = make(map[int64]string)
+	}
+	b.knownProfiles[user.ID] = profile
+	b.knownProfilesLock.Unlock()
+	return nil
+}
+
+func userFullName(user *telebot.User) string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s", user.FirstName, user.LastName))
+}
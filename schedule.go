@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+const (
+	scheduleTimeLayout = "2006-01-02T15:04"
+	schedulerInterval  = 30 * time.Second
+)
+
+// command: /schedule [-tmpl] <when> <repeat> <topic> <mailing_list> <message_body>
+// or as a reply to any message: /schedule [-tmpl] <when> <repeat> <topic> <mailing_list>
+// when: 2006-01-02T15:04 (server time) or +<duration>, e.g. +2h30m
+// repeat: once, daily, weekly or <duration>, e.g. 36h
+func (b *Bot) handleSchedule(ctx telebot.Context) error {
+	const usage = "Пожалуйста, введите данные в формате /schedule [-tmpl] <время> <повтор> <топик> <Список> <MessageBody>\n" +
+		"время: 2006-01-02T15:04 или +2h30m\nповтор: once, daily, weekly или интервал, например 36h\n" +
+		"Для медиа ответьте на сообщение командой /schedule [-tmpl] <время> <повтор> <топик> <Список>\n" +
+		"С -tmpl в тексте подставляются {{.RecipientName}}, {{.TGName}} и поля из файла, импортированного командой /import_list\n" +
+		"Запланированные рассылки отправляются без кнопок реакций, они добавляются только через /broadcast"
+	args, tmpl := cutTemplateFlag(ctx.Args())
+	replyTo := ctx.Message().ReplyTo
+	if (replyTo == nil && len(args) < 5) || (replyTo != nil && len(args) != 4) {
+		return ctx.Send(usage)
+	}
+
+	runAt, err := parseScheduleTime(args[0], time.Now())
+	if err != nil {
+		return ctx.Send(fmt.Sprintf("Неверное время: %v\n\n%s", err, usage))
+	}
+	repeatEvery, err := parseRepeat(args[1])
+	if err != nil {
+		return ctx.Send(fmt.Sprintf("Неверный повтор: %v\n\n%s", err, usage))
+	}
+	list, ok, err := b.findMailingList(ctx, args[3])
+	if err != nil || !ok {
+		return err
+	}
+
+	var content MessageContent
+	if replyTo != nil {
+		content = messageContent(replyTo)
+	} else {
+		// the body follows time, repeat, topic, list and the flag if it's given
+		content = MessageContent{Text: commandTail(ctx.Message().Text, len(ctx.Args())-len(args)+4)}
+	}
+	if content.IsEmpty() {
+		return ctx.Send("Это сообщение нельзя разослать")
+	}
+	content.Template = tmpl
+	if tmpl {
+		// the list can change until the job runs, so only the template itself is checked here
+		_, err = parseMessageTemplate(content.Text)
+		if err != nil {
+			return ctx.Send(formatTemplateError(&templateError{Err: err}))
+		}
+	}
+
+	topic, err := b.getOrAddTopic(senderOrgId(ctx), args[2])
+	if err != nil {
+		log.Errorf("schedule: create topic: %v", err)
+		return err
+	}
+
+	job, err := b.db.AddJob(models.Job{
+		SenderTGId:  senderOrgId(ctx),
+		TopicId:     topic.TopicId,
+		ListId:      list.ListId,
+		Message:     content.Text,
+		MediaType:   content.MediaType,
+		FileId:      content.FileId,
+		Template:    content.Template,
+		RunAt:       runAt,
+		RepeatEvery: repeatEvery,
+		Status:      models.JobStatusPending,
+	})
+	if err != nil {
+		log.Errorf("schedule: save job: %v", err)
+		return err
+	}
+
+	return ctx.Send(fmt.Sprintf("Рассылка #%d запланирована на %s (%s)", job.JobId, runAt.Format(scheduleTimeLayout), formatRepeat(repeatEvery)))
+}
+
+// command: /jobs
+func (b *Bot) handleJobs(ctx telebot.Context) error {
+	jobs, err := b.db.GetPendingJobsBySender(senderOrgId(ctx))
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return ctx.Send("Нет запланированных рассылок")
+	}
+
+	str := new(strings.Builder)
+	str.WriteString("Запланированные рассылки:")
+	for _, job := range jobs {
+		topic, err := b.db.GetUserTopicById(job.TopicId)
+		if err != nil {
+			return err
+		}
+		list, err := b.db.GetMailingListById(job.ListId)
+		if err != nil {
+			return err
+		}
+		preview := storedContent(models.Message{Message: job.Message, MediaType: job.MediaType}).Preview()
+		_, _ = fmt.Fprintf(str, "\n\n#%d %s (%s)\nтопик '%s', список '%s'\n%s",
+			job.JobId, job.RunAt.Local().Format(scheduleTimeLayout), formatRepeat(job.RepeatEvery), topic.Topic, list.ListName, preview)
+	}
+	str.WriteString("\n\nИзменить: /job_edit <id> <время> [повтор], отменить: /job_cancel <id>")
+
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
+
+// command: /job_edit <job_id> <when> [repeat]
+func (b *Bot) handleJobEdit(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) < 2 || len(args) > 3 {
+		return ctx.Send("Пожалуйста, введите данные в формате /job_edit <id> <время> [повтор]")
+	}
+	job, err := b.getPendingJob(ctx, args[0])
+	if err != nil || job == nil {
+		return err
+	}
+
+	runAt, err := parseScheduleTime(args[1], time.Now())
+	if err != nil {
+		return ctx.Send(fmt.Sprintf("Неверное время: %v", err))
+	}
+	job.RunAt = runAt
+	if len(args) == 3 {
+		job.RepeatEvery, err = parseRepeat(args[2])
+		if err != nil {
+			return ctx.Send(fmt.Sprintf("Неверный повтор: %v", err))
+		}
+	}
+
+	err = b.db.UpdateJob(*job)
+	if err != nil {
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Рассылка #%d перенесена на %s (%s)", job.JobId, runAt.Format(scheduleTimeLayout), formatRepeat(job.RepeatEvery)))
+}
+
+// command: /job_cancel <job_id>
+func (b *Bot) handleJobCancel(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /job_cancel <id>")
+	}
+	job, err := b.getPendingJob(ctx, args[0])
+	if err != nil || job == nil {
+		return err
+	}
+
+	job.Status = models.JobStatusCancelled
+	err = b.db.UpdateJob(*job)
+	if err != nil {
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Рассылка #%d отменена", job.JobId))
+}
+
+// getPendingJob returns nil job if it doesn't exist or isn't owned by the chat, user is already notified then.
+func (b *Bot) getPendingJob(ctx telebot.Context, idArg string) (*models.Job, error) {
+	jobId, err := strconv.ParseInt(strings.TrimPrefix(idArg, "#"), 10, 64)
+	if err != nil {
+		return nil, ctx.Send("Неверный id рассылки")
+	}
+	job, err := b.db.GetJobById(jobId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (job.SenderTGId != senderOrgId(ctx) || job.Status != models.JobStatusPending)) {
+		return nil, ctx.Send(fmt.Sprintf("Запланированная рассылка #%d не найдена", jobId))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (b *Bot) runScheduler() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			err := b.runDueJobs()
+			if err != nil {
+				log.Errorf("run scheduled jobs: %v", err)
+			}
+		}
+	}
+}
+
+func (b *Bot) runDueJobs() error {
+	now := time.Now()
+	jobs, err := b.db.GetDueJobs(now)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		// job is moved forward before sending, so a crash in the middle doesn't repeat the broadcast
+		if job.RepeatEvery > 0 {
+			for !job.RunAt.After(now) {
+				job.RunAt = job.RunAt.Add(job.RepeatEvery)
+			}
+		} else {
+			job.Status = models.JobStatusDone
+		}
+		err = b.db.UpdateJob(job)
+		if err != nil {
+			return err
+		}
+
+		topic, err := b.db.GetUserTopicById(job.TopicId)
+		if err != nil {
+			return err
+		}
+		content := MessageContent{MediaType: job.MediaType, FileId: job.FileId, Text: job.Message, Template: job.Template}
+		broadcast, err := b.broadcast(job.SenderTGId, topic, job.ListId, content, false)
+		var tmplErr *templateError
+		if errors.As(err, &tmplErr) {
+			b.notifyOrganization(job.SenderTGId, fmt.Sprintf("Запланированная рассылка #%d: %s", job.JobId, formatTemplateError(tmplErr)))
+			continue
+		}
+		if err != nil {
+			log.Errorf("scheduled broadcast #%d: %v", job.JobId, err)
+			b.notifyOrganization(job.SenderTGId, fmt.Sprintf("Не удалось отправить запланированную рассылку #%d", job.JobId))
+			continue
+		}
+		b.notifyOrganization(job.SenderTGId,
+			fmt.Sprintf("Запланированная рассылка #%d по топику '%s' поставлена в очередь как рассылка #%d", job.JobId, topic.Topic, broadcast.BroadcastId))
+	}
+
+	return nil
+}
+
+func parseScheduleTime(s string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(s, "+") {
+		d, err := time.ParseDuration(s[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if d <= 0 {
+			return time.Time{}, errors.New("time is in the past")
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.ParseInLocation(scheduleTimeLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected %s or +<duration>", scheduleTimeLayout)
+	}
+	if t.Before(now) {
+		return time.Time{}, errors.New("time is in the past")
+	}
+	return t, nil
+}
+
+func parseRepeat(s string) (time.Duration, error) {
+	switch s {
+	case "once":
+		return 0, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("expected once, daily, weekly or duration")
+	}
+	if d < time.Minute {
+		return 0, errors.New("repeat interval must be at least 1m")
+	}
+	return d, nil
+}
+
+func formatRepeat(d time.Duration) string {
+	switch d {
+	case 0:
+		return "однократно"
+	case 24 * time.Hour:
+		return "ежедневно"
+	case 7 * 24 * time.Hour:
+		return "еженедельно"
+	default:
+		return fmt.Sprintf("каждые %s", d)
+	}
+}
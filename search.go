@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/pymq/tfahack/db"
+	"gopkg.in/telebot.v3"
+)
+
+const searchResultsLimit = 15
+
+// command: /search <words>
+func (b *Bot) handleSearch(ctx telebot.Context) error {
+	searchQuery := commandTail(ctx.Message().Text, 0)
+	if strings.TrimSpace(searchQuery) == "" {
+		return ctx.Send("Пожалуйста, введите данные в формате /search <слова>\nБудут найдены ответы, содержащие все слова или слова, начинающиеся с них")
+	}
+	results, count, err := b.db.SearchRecipientMessages(senderOrgId(ctx), searchQuery, searchResultsLimit)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ctx.Send("Ничего не найдено")
+	}
+
+	recipientTGIds := make([]int64, 0, len(results))
+	for _, result := range results {
+		recipientTGIds = append(recipientTGIds, result.RecipientId)
+	}
+	recipients, err := b.db.GetRecipientsByIds(recipientTGIds)
+	if err != nil {
+		return err
+	}
+	titles := make(map[int64]string, len(recipients))
+	for _, recipient := range recipients {
+		titles[recipient.RecipientTGId] = recipientTitle(recipient)
+	}
+
+	header := fmt.Sprintf("Найдено ответов: %d", count)
+	if count > len(results) {
+		header += fmt.Sprintf(", показаны %d самых подходящих", len(results))
+	}
+	const maxMessageSize = 4096
+	parts := []string{html.EscapeString(header)}
+	for _, result := range results {
+		const timeLayout = "2006-01-02 15:04"
+		entry := fmt.Sprintf("\n\n<b>%s</b> · %s · %s\n%s",
+			html.EscapeString(result.Topic), html.EscapeString(titles[result.RecipientId]),
+			result.SendDateTime.Format(timeLayout), highlightSnippet(result.Snippet))
+		// entries are kept whole, so html tags are never split between messages
+		if last := len(parts) - 1; len(parts[last])+len(entry) <= maxMessageSize {
+			parts[last] += entry
+		} else {
+			parts = append(parts, strings.TrimPrefix(entry, "\n\n"))
+		}
+	}
+	for _, part := range parts {
+		_, err = b.client.Send(ctx.Recipient(), part, telebot.ModeHTML, telebot.NoPreview)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// highlightSnippet escapes snippet for HTML parse mode and makes matched words bold.
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, db.SnippetMatchStart, "<b>")
+	return strings.ReplaceAll(snippet, db.SnippetMatchEnd, "</b>")
+}
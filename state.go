@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lastUpdateIdKey      = "last_update_id"
+	stateCleanupInterval = time.Hour
+)
+
+// prepareLongPolling removes webhook left from webhook mode, telegram doesn't allow polling while it's set,
+// and makes long polling continue after the last update fetched before restart.
+func (b *Bot) prepareLongPolling() error {
+	webhook, err := b.client.Webhook()
+	if err != nil {
+		return err
+	}
+	if webhook.Listen != "" { // webhook url
+		log.Infof("removing webhook %s to use long polling", webhook.Listen)
+		err = b.client.RemoveWebhook()
+		if err != nil {
+			return err
+		}
+	}
+
+	lastUpdateId, err := b.db.GetBotState(lastUpdateIdKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b.poller.LastUpdateID = int(lastUpdateId)
+	return nil
+}
+
+// savePollerOffset must be called after the poller is stopped.
+func (b *Bot) savePollerOffset() error {
+	lastUpdateId := b.poller.LastUpdateID
+	// updates fetched but not processed yet are fetched again after restart
+	for len(b.client.Updates) > 0 {
+		update := <-b.client.Updates
+		if update.ID <= lastUpdateId {
+			lastUpdateId = update.ID - 1
+		}
+	}
+	return b.db.SaveBotState(lastUpdateIdKey, int64(lastUpdateId))
+}
+
+func (b *Bot) runStateCleanup() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(stateCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			err := b.cleanupState()
+			if err != nil {
+				log.Errorf("cleanup paging state: %v", err)
+			}
+		}
+	}
+}
+
+func (b *Bot) cleanupState() error {
+	expiredBefore := time.Now().Add(-b.cfg.PagingStateTTL.Duration)
+	pagedMessages, err := b.db.DeletePagedMessagesShownBefore(expiredBefore)
+	if err != nil {
+		return err
+	}
+	callbackStates, err := b.db.DeleteCallbackStatesUpdatedBefore(expiredBefore)
+	if err != nil {
+		return err
+	}
+	if pagedMessages > 0 || callbackStates > 0 {
+		log.Infof("removed expired paging state: %d paged messages, %d keyboards", pagedMessages, callbackStates)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pymq/tfahack/db"
+	"gopkg.in/telebot.v3"
+)
+
+const (
+	statsDayLayout = "2006-01-02"
+	// activity is shown for the last days if the range isn't limited
+	defaultActivityDays = 14
+	maxChartDays        = 366
+)
+
+// command: /topics_stats [<from> [<to>]] [chart]
+// from and to are dates 2006-01-02, to is inclusive; from may be <n>d for the last n days.
+// chart sends activity by day as a picture.
+func (b *Bot) handleTopicsStats(ctx telebot.Context) error {
+	const usage = "Пожалуйста, введите данные в формате /topics_stats [<с> [<по>]] [chart]\n" +
+		"даты в формате 2006-01-02, вместо начала можно указать число последних дней, например 30d; chart - прислать график активности"
+	args := ctx.Args()
+	chart := len(args) > 0 && args[len(args)-1] == "chart"
+	if chart {
+		args = args[:len(args)-1]
+	}
+	from, to, err := parseStatsRange(args, time.Now())
+	if err != nil {
+		return ctx.Send(fmt.Sprintf("Неверный период: %v\n\n%s", err, usage))
+	}
+
+	orgId := senderOrgId(ctx)
+	topics, err := b.db.GetTopicStats(orgId, from, to, false)
+	if err != nil {
+		return err
+	}
+	lists, err := b.db.GetTopicStats(orgId, from, to, true)
+	if err != nil {
+		return err
+	}
+	reactions, err := b.db.GetTopicReactionCounts(orgId, from, to)
+	if err != nil {
+		return err
+	}
+	topicLists := make(map[int64][]db.TopicStats)
+	for _, list := range lists {
+		topicLists[list.TopicId] = append(topicLists[list.TopicId], list)
+	}
+
+	str := new(strings.Builder)
+	_, _ = fmt.Fprintf(str, "Статистика по топикам %s:", formatStatsRange(from, to))
+	if len(topics) == 0 {
+		str.WriteString("\nсообщений нет")
+	}
+	for _, topic := range topics {
+		_, _ = fmt.Fprintf(str, "\n\n%s: отправлено %d; получено %d; из них медиа %d", topic.Topic, topic.Sent, topic.Received, topic.Media)
+		// read means the recipient pressed a button on the message or replied to it
+		_, _ = fmt.Fprintf(str, "; прочитано %d (%d%%); реакции %d (%d%%)", topic.Read, percent(topic.Read, topic.Sent), topic.Reacted, percent(topic.Reacted, topic.Sent))
+		if topic.Reacted > 0 {
+			counts := make([]string, 0, len(reactionButtons))
+			for _, button := range reactionButtons {
+				counts = append(counts, fmt.Sprintf("%s %d", button.Text, reactions[topic.TopicId][button.React]))
+			}
+			_, _ = fmt.Fprintf(str, ": %s", strings.Join(counts, ", "))
+		}
+		_, _ = fmt.Fprintf(str, "\nответили %s", formatResponses(topic))
+		if len(topicLists[topic.TopicId]) > 1 {
+			for _, list := range topicLists[topic.TopicId] {
+				name := fmt.Sprintf("'%s'", list.ListName)
+				switch {
+				case list.ListId == 0:
+					name = "без списка"
+				case list.ListName == "":
+					name = fmt.Sprintf("#%d (удален)", list.ListId)
+				}
+				_, _ = fmt.Fprintf(str, "\n• список %s: отправлено %d; получено %d; ответили %s", name, list.Sent, list.Received, formatResponses(list))
+			}
+		}
+	}
+
+	activityFrom, activityTo := from, to
+	if activityFrom.IsZero() {
+		activityFrom = statsToday(time.Now()).AddDate(0, 0, -defaultActivityDays+1)
+	}
+	if activityTo.IsZero() {
+		activityTo = statsToday(time.Now()).AddDate(0, 0, 1)
+	}
+	activity, err := b.db.GetDailyActivity(orgId, activityFrom, activityTo)
+	if err != nil {
+		return err
+	}
+	if len(activity) > 0 {
+		_, _ = fmt.Fprintf(str, "\n\nАктивность по дням %s:", formatStatsRange(activityFrom, activityTo))
+		for _, day := range activity {
+			_, _ = fmt.Fprintf(str, "\n%s: отправлено %d; получено %d", day.Day, day.Sent, day.Received)
+		}
+	}
+
+	optOuts, err := b.db.GetOptOutStatsBySender(orgId)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(str, "\n\nОтписались от всех ваших рассылок: %d\nОтписались от отдельных списков: %d\nОтписались от всех рассылок в боте: %d",
+		optOuts.FromSender, optOuts.FromLists, optOuts.Global)
+
+	err = b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+	if err != nil || !chart {
+		return err
+	}
+
+	days := int(activityTo.Sub(activityFrom).Hours() / 24)
+	if days < 1 {
+		days = 1
+	}
+	if days > maxChartDays {
+		return ctx.Send(fmt.Sprintf("График строится не больше чем за %d дней, укажите период короче", maxChartDays))
+	}
+	return b.sendActivityChart(ctx, activity, activityFrom, days)
+}
+
+// sendActivityChart sends a chart of the activity by day starting with from, days without messages are drawn empty.
+func (b *Bot) sendActivityChart(ctx telebot.Context, activity []db.DailyActivity, from time.Time, days int) error {
+	byDay := make(map[string]db.DailyActivity, len(activity))
+	for _, day := range activity {
+		byDay[day.Day] = day
+	}
+	chartDays := make([]chartDay, days)
+	for i := range chartDays {
+		day := from.AddDate(0, 0, i)
+		chartDays[i] = chartDay{Day: day, Sent: byDay[day.Format(statsDayLayout)].Sent, Received: byDay[day.Format(statsDayLayout)].Received}
+	}
+	data, err := renderActivityChart(chartDays)
+	if err != nil {
+		return err
+	}
+	return ctx.Send(&telebot.Photo{
+		File:    telebot.FromReader(bytes.NewReader(data)),
+		Caption: fmt.Sprintf("Активность по дням %s: синие - отправленные сообщения, оранжевые - ответы", formatStatsRange(from, from.AddDate(0, 0, days))),
+	})
+}
+
+// parseStatsRange returns [from, to) for /topics_stats arguments, zero time means the range isn't limited.
+// Messages keep local time in UTC location, so the dates are returned in UTC too.
+func parseStatsRange(args []string, now time.Time) (from, to time.Time, err error) {
+	if len(args) > 2 {
+		return time.Time{}, time.Time{}, errors.New("expected at most two dates")
+	}
+	if len(args) > 0 {
+		if strings.HasSuffix(args[0], "d") {
+			n, err := strconv.Atoi(strings.TrimSuffix(args[0], "d"))
+			if err != nil || n < 1 {
+				return time.Time{}, time.Time{}, fmt.Errorf("invalid number of days '%s'", args[0])
+			}
+			from = statsToday(now).AddDate(0, 0, -n+1)
+		} else {
+			from, err = time.Parse(statsDayLayout, args[0])
+			if err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("invalid date '%s'", args[0])
+			}
+			if from.After(statsToday(now)) {
+				return time.Time{}, time.Time{}, errors.New("start date is in the future")
+			}
+		}
+	}
+	if len(args) > 1 {
+		to, err = time.Parse(statsDayLayout, args[1])
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date '%s'", args[1])
+		}
+		to = to.AddDate(0, 0, 1)
+		if !to.After(from) {
+			return time.Time{}, time.Time{}, errors.New("end date is before start date")
+		}
+	}
+	return from, to, nil
+}
+
+// statsToday is the start of the current local day in UTC location, see parseStatsRange.
+func statsToday(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func formatStatsRange(from, to time.Time) string {
+	switch {
+	case from.IsZero() && to.IsZero():
+		return "за все время"
+	case to.IsZero():
+		return fmt.Sprintf("с %s", from.Format(statsDayLayout))
+	case from.IsZero():
+		return fmt.Sprintf("по %s", to.AddDate(0, 0, -1).Format(statsDayLayout))
+	default:
+		return fmt.Sprintf("с %s по %s", from.Format(statsDayLayout), to.AddDate(0, 0, -1).Format(statsDayLayout))
+	}
+}
+
+func formatResponses(stats db.TopicStats) string {
+	str := fmt.Sprintf("%d из %d получателей (%d%%)", stats.Responded, stats.Reached, percent(stats.Responded, stats.Reached))
+	if stats.MedianReplySeconds.Valid {
+		str += fmt.Sprintf(", медиана времени до первого ответа %s", formatReplyDelay(stats.MedianReplySeconds.Float64))
+	}
+	return str
+}
+
+func formatReplyDelay(seconds float64) string {
+	minutes := int(math.Round(seconds / 60))
+	switch {
+	case minutes < 1:
+		return "меньше минуты"
+	case minutes < 60:
+		return fmt.Sprintf("%d мин", minutes)
+	case minutes < 24*60:
+		return fmt.Sprintf("%d ч %d мин", minutes/60, minutes%60)
+	default:
+		return fmt.Sprintf("%d дн %d ч", minutes/(24*60), minutes%(24*60)/60)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStatsRange(t *testing.T) {
+	now := time.Date(2022, 4, 10, 15, 30, 0, 0, time.Local)
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2022, month, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		from, to time.Time
+		wantErr  bool
+	}{
+		{name: "all time", args: nil},
+		{name: "today", args: []string{"1d"}, from: day(4, 10)},
+		{name: "last week", args: []string{"7d"}, from: day(4, 4)},
+		{name: "zero days", args: []string{"0d"}, wantErr: true},
+		{name: "negative days", args: []string{"-3d"}, wantErr: true},
+		{name: "not a number of days", args: []string{"xd"}, wantErr: true},
+		{name: "from date", args: []string{"2022-04-01"}, from: day(4, 1)},
+		{name: "from today", args: []string{"2022-04-10"}, from: day(4, 10)},
+		{name: "from and to", args: []string{"2022-04-01", "2022-04-05"}, from: day(4, 1), to: day(4, 6)},
+		{name: "single day", args: []string{"2022-04-05", "2022-04-05"}, from: day(4, 5), to: day(4, 6)},
+		{name: "days and to", args: []string{"7d", "2022-04-08"}, from: day(4, 4), to: day(4, 9)},
+		{name: "to before from", args: []string{"2022-04-05", "2022-04-04"}, wantErr: true},
+		{name: "future start", args: []string{"2022-04-11"}, wantErr: true},
+		{name: "invalid from", args: []string{"04/01/2022"}, wantErr: true},
+		{name: "invalid to", args: []string{"2022-04-01", "tomorrow"}, wantErr: true},
+		{name: "too many dates", args: []string{"2022-04-01", "2022-04-02", "2022-04-03"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := parseStatsRange(tt.args, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got [%v, %v)", from, to)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !from.Equal(tt.from) || !to.Equal(tt.to) {
+				t.Errorf("got [%v, %v), want [%v, %v)", from, to, tt.from, tt.to)
+			}
+		})
+	}
+}
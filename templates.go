@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+// built-in template variables, custom ones are imported with mailing lists
+const (
+	templateVarRecipientName = "RecipientName"
+	templateVarTGName        = "TGName"
+)
+
+const (
+	maxMessageLength = 4096
+	maxCaptionLength = 1024
+	// shown recipients in template errors
+	maxTemplateErrorRecipients = 5
+)
+
+// templateFlag is the optional first argument of /send_messages and /schedule that turns on templating.
+const templateFlag = "-tmpl"
+
+// templateError means the broadcast template can't be rendered, nothing is sent then.
+type templateError struct {
+	Err error
+	// Recipients the template failed for, empty if the template itself is invalid
+	Recipients []models.Recipient
+}
+
+func (e *templateError) Error() string {
+	if len(e.Recipients) == 0 {
+		return fmt.Sprintf("invalid template: %v", e.Err)
+	}
+	return fmt.Sprintf("template failed for %d recipients: %v", len(e.Recipients), e.Err)
+}
+
+// cutTemplateFlag removes templateFlag from command arguments and reports whether it was there.
+func cutTemplateFlag(args []string) ([]string, bool) {
+	if len(args) > 0 && args[0] == templateFlag {
+		return args[1:], true
+	}
+	return args, false
+}
+
+// parseMessageTemplate parses broadcast text, using a variable the recipient doesn't have is an error.
+func parseMessageTemplate(text string) (*template.Template, error) {
+	return template.New("message").Option("missingkey=error").Parse(text)
+}
+
+// templateData returns variables of the recipient: built-in ones and custom fields.
+func templateData(recipient models.Recipient, fields map[string]string) map[string]string {
+	data := make(map[string]string, len(fields)+2)
+	for name, value := range fields {
+		data[name] = value
+	}
+	data[templateVarRecipientName] = recipient.RecipientName
+	data[templateVarTGName] = recipient.RecipientTGName
+	return data
+}
+
+// renderTemplate renders the message for one recipient, the result must fit into a message or a media caption.
+func renderTemplate(tmpl *template.Template, data map[string]string, media bool) (string, error) {
+	limit := maxMessageLength
+	if media {
+		limit = maxCaptionLength
+	}
+	// the writer stops templates that loop over and over, the runes are checked after rendering
+	str := &limitedBuilder{limit: limit * utf8.UTFMax}
+	err := tmpl.Execute(str, data)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(str.String())
+	if utf8.RuneCountInString(text) > limit {
+		return "", fmt.Errorf("message is longer than %d characters", limit)
+	}
+	if text == "" && !media {
+		return "", errors.New("message is empty")
+	}
+	return text, nil
+}
+
+type limitedBuilder struct {
+	strings.Builder
+	limit int
+}
+
+func (b *limitedBuilder) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errors.New("message is too long")
+	}
+	return b.Builder.Write(p)
+}
+
+// checkTemplate renders the template for every recipient, so that the broadcast isn't started if some of them lack variables.
+func (b *Bot) checkTemplate(senderTGId int64, text string, media bool, recipients []models.Recipient) error {
+	tmpl, err := parseMessageTemplate(text)
+	if err != nil {
+		return &templateError{Err: err}
+	}
+	recipientsIds := make([]int64, len(recipients))
+	for i, recipient := range recipients {
+		recipientsIds[i] = recipient.RecipientId
+	}
+	fields, err := b.db.GetRecipientFields(senderTGId, recipientsIds)
+	if err != nil {
+		return fmt.Errorf("load recipient fields: %v", err)
+	}
+
+	tmplErr := &templateError{}
+	for _, recipient := range recipients {
+		_, err = renderTemplate(tmpl, templateData(recipient, fields[recipient.RecipientId]), media)
+		if err != nil {
+			if tmplErr.Err == nil {
+				tmplErr.Err = err
+			}
+			tmplErr.Recipients = append(tmplErr.Recipients, recipient)
+		}
+	}
+	if len(tmplErr.Recipients) > 0 {
+		return tmplErr
+	}
+	return nil
+}
+
+// renderForRecipient renders the broadcast template for one delivery with current recipient's variables.
+func (b *Bot) renderForRecipient(tmpl *template.Template, senderTGId, recipientTGId int64, media bool) (string, error) {
+	recipients, err := b.db.GetRecipientsByIds([]int64{recipientTGId})
+	if err != nil {
+		return "", err
+	}
+	if len(recipients) == 0 {
+		return "", sql.ErrNoRows
+	}
+	fields, err := b.db.GetRecipientFields(senderTGId, []int64{recipients[0].RecipientId})
+	if err != nil {
+		return "", err
+	}
+	return renderTemplate(tmpl, templateData(recipients[0], fields[recipients[0].RecipientId]), media)
+}
+
+// formatTemplateError explains to the sender why the broadcast wasn't sent.
+func formatTemplateError(err *templateError) string {
+	str := new(strings.Builder)
+	if len(err.Recipients) == 0 {
+		_, _ = fmt.Fprintf(str, "Ошибка в шаблоне: %v", err.Err)
+	} else {
+		_, _ = fmt.Fprintf(str, "Шаблон не удалось заполнить для %d получателей, рассылка не отправлена: %v", len(err.Recipients), err.Err)
+		for i, recipient := range err.Recipients {
+			if i == maxTemplateErrorRecipients {
+				_, _ = fmt.Fprintf(str, "\nи еще %d", len(err.Recipients)-i)
+				break
+			}
+			_, _ = fmt.Fprintf(str, "\n%s", recipientFullTitle(recipient))
+		}
+	}
+	_, _ = fmt.Fprintf(str, "\n\nДоступны переменные {{.%s}}, {{.%s}} и поля из файла, импортированного командой /import_list",
+		templateVarRecipientName, templateVarTGName)
+	return str.String()
+}
+
+// isTemplateFieldName reports whether the imported column can be used as a template variable, e.g. {{.city}}.
+func isTemplateFieldName(name string) bool {
+	if name == "" || name == templateVarRecipientName || name == templateVarTGName {
+		return false
+	}
+	for i, r := range name {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bot) initTemplateHandlers(viewers, editors *telebot.Group) {
+	editors.Handle("/template_save", b.handleTemplateSave)
+	viewers.Handle("/templates", b.handleTemplates)
+	editors.Handle("/template_delete", b.handleTemplateDelete)
+	editors.Handle("/send_template", b.handleSendTemplate)
+}
+
+// command: /template_save <name> <text>
+// or as a reply to a text message: /template_save <name>
+func (b *Bot) handleTemplateSave(ctx telebot.Context) error {
+	const usage = "Пожалуйста, введите данные в формате /template_save <Название> <Текст> или ответьте на сообщение командой /template_save <Название>\n" +
+		"В тексте можно использовать {{.RecipientName}}, {{.TGName}} и поля из файла, импортированного командой /import_list"
+	args := ctx.Args()
+	replyTo := ctx.Message().ReplyTo
+	if len(args) < 1 || (replyTo == nil && len(args) < 2) || (replyTo != nil && len(args) != 1) {
+		return ctx.Send(usage)
+	}
+	text := commandTail(ctx.Message().Text, 1)
+	if replyTo != nil {
+		text = replyTo.Text
+	}
+	if text == "" {
+		return ctx.Send("Шаблоном может быть только текстовое сообщение")
+	}
+	_, err := parseMessageTemplate(text)
+	if err != nil {
+		return ctx.Send(formatTemplateError(&templateError{Err: err}))
+	}
+
+	err = b.db.SaveTemplate(models.MessageTemplate{
+		SenderTGId: senderOrgId(ctx),
+		Name:       args[0],
+		Text:       text,
+		UpdatedAt:  time.Now(),
+	})
+	if err != nil {
+		log.Errorf("save template: %v", err)
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Шаблон '%s' сохранен. Отправить: /send_template <топик> <Список> %s", args[0], args[0]))
+}
+
+// command: /templates
+func (b *Bot) handleTemplates(ctx telebot.Context) error {
+	templates, err := b.db.GetTemplatesBySender(senderOrgId(ctx))
+	if err != nil {
+		return err
+	}
+	if len(templates) == 0 {
+		return ctx.Send("У вас нет шаблонов. Сохраните шаблон командой /template_save <Название> <Текст>")
+	}
+
+	str := new(strings.Builder)
+	str.WriteString("Ваши шаблоны:")
+	for _, tmpl := range templates {
+		_, _ = fmt.Fprintf(str, "\n\n%s:\n%s", tmpl.Name, tmpl.Text)
+	}
+	str.WriteString("\n\nОтправить: /send_template <топик> <Список> <Шаблон>, удалить: /template_delete <Шаблон>")
+	return b.SendLongMessageInParts(ctx.Recipient(), str.String(), false)
+}
+
+// command: /template_delete <name>
+func (b *Bot) handleTemplateDelete(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return ctx.Send("Пожалуйста, введите данные в формате /template_delete <Название>")
+	}
+	deleted, err := b.db.DeleteTemplate(senderOrgId(ctx), args[0])
+	if err != nil {
+		log.Errorf("delete template: %v", err)
+		return err
+	}
+	if !deleted {
+		return ctx.Send("Шаблон не найден, ваши шаблоны: /templates")
+	}
+	return ctx.Send(fmt.Sprintf("Шаблон '%s' удален", args[0]))
+}
+
+// command: /send_template <topic> <mailing_list> <template>
+func (b *Bot) handleSendTemplate(ctx telebot.Context) error {
+	args := ctx.Args()
+	if len(args) != 3 {
+		return ctx.Send("Пожалуйста, введите данные в формате /send_template <IdТопика> <Список> <Шаблон>\n" +
+			"Кнопки реакций добавляются только в рассылках через /broadcast")
+	}
+	list, ok, err := b.findMailingList(ctx, args[1])
+	if err != nil || !ok {
+		return err
+	}
+	tmpl, err := b.db.GetTemplateByName(senderOrgId(ctx), args[2])
+	if errors.Is(err, sql.ErrNoRows) {
+		return ctx.Send("Шаблон не найден, ваши шаблоны: /templates")
+	}
+	if err != nil {
+		return err
+	}
+	topic, err := b.getOrAddTopic(senderOrgId(ctx), args[0])
+	if err != nil {
+		log.Errorf("send template: create topic: %v", err)
+		return err
+	}
+
+	broadcast, err := b.broadcast(senderOrgId(ctx), topic, list.ListId, MessageContent{Text: tmpl.Text, Template: true}, false)
+	var tmplErr *templateError
+	if errors.As(err, &tmplErr) {
+		return ctx.Send(formatTemplateError(tmplErr))
+	}
+	if err != nil {
+		log.Errorf("send template: %v", err)
+		return err
+	}
+	return ctx.Send(fmt.Sprintf("Рассылка #%d поставлена в очередь, отчет о доставке придет по завершении", broadcast.BroadcastId))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/utf8string"
+	"gopkg.in/telebot.v3"
+)
+
+const (
+	threadPageSize      = 10
+	threadPreviewLength = 250
+)
+
+// threadMarkup opens conversation with the recipient within the topic, page 0 is the latest page.
+func threadMarkup(topicId, recipientTGId int64) *telebot.ReplyMarkup {
+	replyMarkup := &telebot.ReplyMarkup{}
+	replyMarkup.Inline(replyMarkup.Row(replyMarkup.Data("Переписка", btnThread.Unique, threadData(topicId, recipientTGId, 0))))
+	return replyMarkup
+}
+
+func threadData(topicId, recipientTGId int64, page int) string {
+	return fmt.Sprintf("%d|%d|%d", topicId, recipientTGId, page)
+}
+
+// callback data: <topic_id>|<recipient_tg_id>|<page>
+// Conversation is sent as a new message from /show_replies and edited in place when paging.
+func (b *Bot) handleThreadButton(ctx telebot.Context) error {
+	data := strings.Split(ctx.Callback().Data, "|")
+	if len(data) != 3 {
+		log.Errorf("invalid data in inline keyboard callback: '%s'", ctx.Callback().Data)
+		return b.handleExpiredCallback(ctx)
+	}
+	topicId, errTopic := strconv.ParseInt(data[0], 10, 64)
+	recipientTGId, errRecipient := strconv.ParseInt(data[1], 10, 64)
+	page, errPage := strconv.Atoi(data[2])
+	if errTopic != nil || errRecipient != nil || errPage != nil {
+		log.Errorf("invalid data in inline keyboard callback: '%s'", ctx.Callback().Data)
+		return b.handleExpiredCallback(ctx)
+	}
+
+	topic, err := b.db.GetUserTopicById(topicId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && topic.SenderTGId != senderOrgId(ctx)) {
+		return b.handleExpiredCallback(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	recipients, err := b.db.GetRecipientsByIds([]int64{recipientTGId})
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return b.handleExpiredCallback(ctx)
+	}
+	recipient := recipients[0]
+	messages, err := b.db.GetTopicConversation(topic.TopicId, recipient)
+	if err != nil {
+		return err
+	}
+
+	newThread := page == 0
+	totalPages := (len(messages) + threadPageSize - 1) / threadPageSize
+	if page <= 0 || page > totalPages {
+		page = totalPages
+	}
+	text := formatThread(topic, recipient, messages, page, totalPages)
+	markup := threadPagingMarkup(topic.TopicId, recipientTGId, page, totalPages)
+
+	var threadMessage *telebot.Message
+	if newThread {
+		threadMessage, err = b.client.Send(ctx.Recipient(), text, markup, telebot.NoPreview)
+	} else {
+		threadMessage, err = b.client.Edit(ctx.Message(), text, markup, telebot.NoPreview)
+		if isNotModified(err) {
+			threadMessage, err = ctx.Message(), nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// replying to the conversation answers the recipient as a reply to their latest message
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].IsRecipientMessage == 1 {
+			err = b.db.SavePagedMessage(models.PagedMessage{
+				ChatId:      ctx.Chat().ID,
+				MessageTGId: int64(threadMessage.ID),
+				MessageId:   messages[i].MessageId,
+				ShownAt:     time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return ctx.Respond()
+}
+
+func formatThread(topic models.Topic, recipient models.Recipient, messages []models.Message, page, totalPages int) string {
+	const timeLayout = "2006-01-02 15:04"
+	str := new(strings.Builder)
+	_, _ = fmt.Fprintf(str, "Переписка с %s по топику '%s'", recipientFullTitle(recipient), topic.Topic)
+	if totalPages > 1 {
+		_, _ = fmt.Fprintf(str, ", страница %d из %d", page, totalPages)
+	}
+	for i := (page - 1) * threadPageSize; i >= 0 && i < page*threadPageSize && i < len(messages); i++ {
+		message := messages[i]
+		author := recipientTitle(recipient)
+		if message.IsRecipientMessage == 0 {
+			author = "вы"
+		}
+		preview := utf8string.NewString(storedContent(message).Preview())
+		text := preview.String()
+		if preview.RuneCount() > threadPreviewLength {
+			text = preview.Slice(0, threadPreviewLength) + "…"
+		}
+		_, _ = fmt.Fprintf(str, "\n\n%s, %s:\n%s", author, message.SendDateTime.Format(timeLayout), text)
+	}
+	str.WriteString("\n\nОтветьте на это сообщение, чтобы написать получателю")
+	return str.String()
+}
+
+func threadPagingMarkup(topicId, recipientTGId int64, page, totalPages int) *telebot.ReplyMarkup {
+	if totalPages <= 1 {
+		return nil
+	}
+	replyMarkup := &telebot.ReplyMarkup{}
+	var buttons []telebot.Btn
+	if page > 1 {
+		buttons = append(buttons, replyMarkup.Data("« раньше", btnThread.Unique, threadData(topicId, recipientTGId, page-1)))
+	}
+	if page < totalPages {
+		buttons = append(buttons, replyMarkup.Data("позже »", btnThread.Unique, threadData(topicId, recipientTGId, page+1)))
+	}
+	replyMarkup.Inline(replyMarkup.Row(buttons...))
+	return replyMarkup
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+// unsubscribe buttons carry list id in data, so they work for any broadcast after restart
+var (
+	btnUnsubscribe       = &telebot.Btn{Unique: "unsub"}
+	btnUnsubscribeList   = &telebot.Btn{Unique: "unsub_list"}
+	btnUnsubscribeSender = &telebot.Btn{Unique: "unsub_sender"}
+	btnUnsubscribeAll    = &telebot.Btn{Unique: "unsub_all"}
+)
+
+func (b *Bot) initUnsubscribeHandlers() {
+	b.client.Handle("/stop", b.handleStop, IgnoreNonPrivateMessages)
+	b.client.Handle(btnUnsubscribe, b.handleUnsubscribeButton)
+	b.client.Handle(btnUnsubscribeList, b.handleUnsubscribeListButton)
+	b.client.Handle(btnUnsubscribeSender, b.handleUnsubscribeSenderButton)
+	b.client.Handle(btnUnsubscribeAll, b.handleUnsubscribeAllButton)
+}
+
+// command: /stop
+func (b *Bot) handleStop(ctx telebot.Context) error {
+	recipient, ok, err := b.currentRecipient(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	return b.unsubscribeAll(ctx, recipient)
+}
+
+func (b *Bot) handleUnsubscribeButton(ctx telebot.Context) error {
+	b.markCallbackMessageRead(ctx)
+	list, ok, err := b.callbackMailingList(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	_ = ctx.Respond()
+
+	data := strconv.FormatInt(list.ListId, 10)
+	var replyMarkup = &telebot.ReplyMarkup{}
+	replyMarkup.Inline(
+		replyMarkup.Row(replyMarkup.Data("От этого списка", btnUnsubscribeList.Unique, data)),
+		replyMarkup.Row(replyMarkup.Data("От всех рассылок этого отправителя", btnUnsubscribeSender.Unique, data)),
+		replyMarkup.Row(replyMarkup.Data("От всех рассылок", btnUnsubscribeAll.Unique)),
+	)
+	return ctx.Send("От каких рассылок вы хотите отписаться?", replyMarkup)
+}
+
+func (b *Bot) handleUnsubscribeListButton(ctx telebot.Context) error {
+	return b.addOptOut(ctx, false)
+}
+
+func (b *Bot) handleUnsubscribeSenderButton(ctx telebot.Context) error {
+	return b.addOptOut(ctx, true)
+}
+
+func (b *Bot) handleUnsubscribeAllButton(ctx telebot.Context) error {
+	_ = ctx.Respond()
+	recipient, ok, err := b.currentRecipient(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	return b.unsubscribeAll(ctx, recipient)
+}
+
+func (b *Bot) addOptOut(ctx telebot.Context, wholeSender bool) error {
+	list, ok, err := b.callbackMailingList(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	_ = ctx.Respond()
+	recipient, ok, err := b.currentRecipient(ctx)
+	if err != nil || !ok {
+		return err
+	}
+
+	optOut := models.OptOut{
+		RecipientId: recipient.RecipientId,
+		SenderTGId:  list.SenderTGId,
+		ListId:      list.ListId,
+		CreatedAt:   time.Now(),
+	}
+	if wholeSender {
+		optOut.ListId = 0
+	}
+	err = b.db.AddOptOut(optOut)
+	if err != nil {
+		log.Errorf("unsubscribe: save opt-out: %v", err)
+		return err
+	}
+
+	if wholeSender {
+		return ctx.Send("Вы отписались от всех рассылок этого отправителя")
+	}
+	return ctx.Send("Вы отписались от этого списка рассылки")
+}
+
+func (b *Bot) unsubscribeAll(ctx telebot.Context, recipient models.Recipient) error {
+	err := b.db.SetRecipientUnsubscribed(recipient.RecipientId, true)
+	if err != nil {
+		log.Errorf("unsubscribe: %v", err)
+		return err
+	}
+	return ctx.Send("Вы отписались от всех рассылок. Чтобы снова получать их, отправьте /start")
+}
+
+// currentRecipient returns recipient of the chat, ok is false if chat isn't subscribed, user is already notified then.
+func (b *Bot) currentRecipient(ctx telebot.Context) (models.Recipient, bool, error) {
+	recipients, err := b.db.GetRecipientsByIds([]int64{ctx.Chat().ID})
+	if err != nil {
+		return models.Recipient{}, false, err
+	}
+	if len(recipients) == 0 {
+		return models.Recipient{}, false, ctx.Send("Вы не подписаны на рассылки")
+	}
+	return recipients[0], true, nil
+}
+
+// callbackMailingList returns mailing list from callback data, ok is false if it doesn't exist anymore.
+func (b *Bot) callbackMailingList(ctx telebot.Context) (models.MailingList, bool, error) {
+	listId, err := strconv.ParseInt(ctx.Callback().Data, 10, 64)
+	if err != nil {
+		return models.MailingList{}, false, ctx.Respond()
+	}
+	list, err := b.db.GetMailingListById(listId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.MailingList{}, false, ctx.Respond(&telebot.CallbackResponse{Text: "Этот список рассылки уже удален"})
+	}
+	if err != nil {
+		return models.MailingList{}, false, err
+	}
+	return list, true, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+const (
+	webhookSecretHeader   = "X-Telegram-Bot-Api-Secret-Token"
+	webhookShutdownPeriod = 10 * time.Second
+)
+
+// WebhookPoller receives updates with the built-in HTTP(S) server instead of long polling.
+// Telegram's webhook is registered by Prepare if PublicURL is set, otherwise it's expected to be
+// registered elsewhere with the same secret token, e.g. for local testing updates are posted to the endpoint by hand:
+//
+//	curl -H 'X-Telegram-Bot-Api-Secret-Token: <secret>' -d @update.json http://localhost:8443/
+//
+// The webhook is kept on shutdown, so telegram holds new updates until the bot is started again.
+type WebhookPoller struct {
+	Listen      string
+	PublicURL   string
+	SecretToken string
+	TLSCert     string
+	TLSKey      string
+
+	bot      *telebot.Bot
+	listener net.Listener
+	dest     chan<- telebot.Update
+	stop     chan struct{}
+}
+
+func NewWebhookPoller(cfg Config) *WebhookPoller {
+	return &WebhookPoller{
+		Listen:      cfg.WebhookListen,
+		PublicURL:   cfg.WebhookURL,
+		SecretToken: cfg.WebhookSecret,
+		TLSCert:     cfg.WebhookTLSCert,
+		TLSKey:      cfg.WebhookTLSKey,
+	}
+}
+
+// Prepare registers the webhook and opens the listener before the bot is started,
+// so that a busy port, a bad certificate or a rejected url stop the start instead of leaving the bot without updates.
+func (p *WebhookPoller) Prepare(b *telebot.Bot) error {
+	p.bot = b
+	if p.SecretToken == "" {
+		return errors.New("secret token is required")
+	}
+
+	listener, err := net.Listen("tcp", p.Listen)
+	if err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	if p.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(p.TLSCert, p.TLSKey)
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("load certificate: %v", err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	if p.PublicURL != "" {
+		err = p.register()
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("register: %v", err)
+		}
+	}
+	p.listener = listener
+	return nil
+}
+
+func (p *WebhookPoller) Poll(b *telebot.Bot, dest chan telebot.Update, stop chan struct{}) {
+	p.dest = dest
+	p.stop = stop
+
+	path := "/"
+	if u, err := url.Parse(p.PublicURL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, p)
+	server := &http.Server{Addr: p.Listen, Handler: mux}
+
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.Serve(p.listener)
+	}()
+	log.Infof("webhook: listening on %s%s", p.Listen, path)
+
+	select {
+	case err := <-serveErrCh:
+		log.Errorf("webhook: serve: %v", err)
+		<-stop
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), webhookShutdownPeriod)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Errorf("webhook: shutdown: %v", err)
+		}
+	}
+}
+
+func (p *WebhookPoller) register() error {
+	_, err := p.bot.Raw("setWebhook", map[string]string{"url": p.PublicURL, "secret_token": p.SecretToken})
+	return err
+}
+
+func (p *WebhookPoller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookSecretHeader)), []byte(p.SecretToken)) != 1 {
+		log.Warnf("webhook: request from %s with invalid secret token", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var update telebot.Update
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		log.Warnf("webhook: decode update: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case <-p.stop:
+		// telegram retries the update after restart
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	select {
+	case p.dest <- update:
+		w.WriteHeader(http.StatusOK)
+	case <-p.stop:
+		// telegram retries the update after restart
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// validateWebhookSecret checks telegram's limits for secret_token: 1-256 characters of A-Z, a-z, 0-9, _ and -.
+// The secret is required, without it anyone who can reach the endpoint could post updates on behalf of any user.
+func validateWebhookSecret(secret string) error {
+	if secret == "" {
+		return errors.New("is required in webhook mode")
+	}
+	if len(secret) > 256 {
+		return errors.New("must be at most 256 characters")
+	}
+	for _, r := range secret {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return errors.New("may contain only A-Z, a-z, 0-9, _ and -")
+		}
+	}
+	return nil
+}
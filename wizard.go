@@ -0,0 +1,403 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pymq/tfahack/models"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/telebot.v3"
+)
+
+// broadcast wizard states, stored in models.Conversation.State
+const (
+	wizardStateTopic   = "broadcast_topic"
+	wizardStateList    = "broadcast_list"
+	wizardStateContent = "broadcast_content"
+	wizardStateConfirm = "broadcast_confirm"
+)
+
+// wizard buttons have static uniques so they keep working after restart
+var (
+	btnWizardTopic   = &telebot.Btn{Unique: "wiz_topic"}
+	btnWizardList    = &telebot.Btn{Unique: "wiz_list"}
+	btnWizardConfirm = &telebot.Btn{Unique: "wiz_confirm"}
+	btnWizardReacts  = &telebot.Btn{Unique: "wiz_reacts"}
+	btnWizardTmpl    = &telebot.Btn{Unique: "wiz_tmpl"}
+	btnWizardCancel  = &telebot.Btn{Unique: "wiz_cancel"}
+)
+
+// broadcastDraft is stored as JSON in models.Conversation.Data.
+type broadcastDraft struct {
+	// TopicId is 0 for a topic that will be created on confirm
+	TopicId   int64          `json:"topic_id"`
+	TopicName string         `json:"topic_name"`
+	ListId    int64          `json:"list_id"`
+	ListName  string         `json:"list_name"`
+	Content   MessageContent `json:"content"`
+	// Reactions attaches 👍 / 👎 / Понятно buttons to delivered messages
+	Reactions bool `json:"reactions"`
+}
+
+func (b *Bot) initWizardHandlers(group *telebot.Group) {
+	group.Handle("/broadcast", b.handleBroadcast)
+	group.Handle("/cancel", b.handleWizardCancel)
+	group.Handle(btnWizardTopic, b.handleWizardTopicButton)
+	group.Handle(btnWizardList, b.handleWizardListButton)
+	group.Handle(btnWizardConfirm, b.handleWizardConfirmButton)
+	group.Handle(btnWizardReacts, b.handleWizardReactsButton)
+	group.Handle(btnWizardTmpl, b.handleWizardTmplButton)
+	group.Handle(btnWizardCancel, b.handleWizardCancel)
+}
+
+// command: /broadcast
+func (b *Bot) handleBroadcast(ctx telebot.Context) error {
+	topics, err := b.db.GetUserTopicsBySender(senderOrgId(ctx))
+	if err != nil {
+		return err
+	}
+
+	err = b.saveWizard(ctx.Chat().ID, wizardStateTopic, broadcastDraft{})
+	if err != nil {
+		return err
+	}
+
+	var replyMarkup = &telebot.ReplyMarkup{}
+	rows := make([]telebot.Row, 0, len(topics)+1)
+	for _, topic := range topics {
+		btn := replyMarkup.Data(topic.Topic, btnWizardTopic.Unique, strconv.FormatInt(topic.TopicId, 10))
+		rows = append(rows, replyMarkup.Row(btn))
+	}
+	rows = append(rows, replyMarkup.Row(replyMarkup.Data("Отмена", btnWizardCancel.Unique)))
+	replyMarkup.Inline(rows...)
+
+	return ctx.Send("Шаг 1/4. Выберите топик или отправьте название нового", replyMarkup)
+}
+
+func (b *Bot) handleWizardTopicButton(ctx telebot.Context) error {
+	_ = ctx.Respond()
+	draft, ok, err := b.loadWizard(ctx, wizardStateTopic)
+	if err != nil || !ok {
+		return err
+	}
+
+	topicId, err := strconv.ParseInt(ctx.Callback().Data, 10, 64)
+	if err != nil {
+		return err
+	}
+	topic, err := b.db.GetUserTopicById(topicId)
+	if err != nil {
+		return err
+	}
+	if topic.SenderTGId != senderOrgId(ctx) {
+		return nil
+	}
+
+	draft.TopicId = topic.TopicId
+	draft.TopicName = topic.Topic
+	return b.askWizardList(ctx, draft)
+}
+
+func (b *Bot) askWizardList(ctx telebot.Context, draft broadcastDraft) error {
+	lists, err := b.db.GetMailingListBySender(senderOrgId(ctx))
+	if err != nil {
+		return err
+	}
+	if len(lists) == 0 {
+		_ = b.db.DeleteConversation(ctx.Chat().ID)
+		return ctx.Send("У вас нет списков рассылки. Создайте список командой /create_mailing_list")
+	}
+
+	err = b.saveWizard(ctx.Chat().ID, wizardStateList, draft)
+	if err != nil {
+		return err
+	}
+
+	var replyMarkup = &telebot.ReplyMarkup{}
+	rows := make([]telebot.Row, 0, len(lists)+1)
+	for _, list := range lists {
+		btn := replyMarkup.Data(list.ListName, btnWizardList.Unique, strconv.FormatInt(list.ListId, 10))
+		rows = append(rows, replyMarkup.Row(btn))
+	}
+	rows = append(rows, replyMarkup.Row(replyMarkup.Data("Отмена", btnWizardCancel.Unique)))
+	replyMarkup.Inline(rows...)
+
+	return ctx.Send(fmt.Sprintf("Шаг 2/4. Топик '%s'. Выберите список рассылки", draft.TopicName), replyMarkup)
+}
+
+func (b *Bot) handleWizardListButton(ctx telebot.Context) error {
+	_ = ctx.Respond()
+	draft, ok, err := b.loadWizard(ctx, wizardStateList)
+	if err != nil || !ok {
+		return err
+	}
+
+	listId, err := strconv.ParseInt(ctx.Callback().Data, 10, 64)
+	if err != nil {
+		return err
+	}
+	list, err := b.db.GetMailingListById(listId)
+	if err != nil {
+		return err
+	}
+	if list.SenderTGId != senderOrgId(ctx) {
+		return nil
+	}
+
+	draft.ListId = list.ListId
+	draft.ListName = list.ListName
+	err = b.saveWizard(ctx.Chat().ID, wizardStateContent, draft)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Send(fmt.Sprintf("Шаг 3/4. Список '%s'. Отправьте сообщение для рассылки: текст, фото, документ, видео или голосовое", list.ListName))
+}
+
+// handleWizardMessage handles text and media messages while wizard is waiting for input.
+// It returns false if chat has no active wizard.
+func (b *Bot) handleWizardMessage(ctx telebot.Context) (bool, error) {
+	conversation, err := b.db.GetConversation(ctx.Chat().ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	// wizard is started by organization editors only, membership or role may be lost in the meantime
+	_, ok, err := b.orgMember(ctx)
+	if err != nil {
+		return true, err
+	}
+	if !ok {
+		return false, nil
+	}
+	return true, b.RequireRole(models.OrgRoleEditor)(func(ctx telebot.Context) error {
+		return b.handleWizardStep(ctx, conversation.State)
+	})(ctx)
+}
+
+// handleWizardStep handles input of the wizard in the state.
+func (b *Bot) handleWizardStep(ctx telebot.Context, state string) error {
+	switch state {
+	case wizardStateTopic:
+		draft, ok, err := b.loadWizard(ctx, wizardStateTopic)
+		if err != nil || !ok {
+			return err
+		}
+		topicName := ctx.Message().Text
+		if topicName == "" {
+			return ctx.Send("Отправьте название топика текстом")
+		}
+		draft.TopicName = topicName
+		topic, err := b.db.GetTopicByTopicNameAndSender(topicName, senderOrgId(ctx))
+		if err == nil {
+			draft.TopicId = topic.TopicId
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		return b.askWizardList(ctx, draft)
+	case wizardStateContent:
+		draft, ok, err := b.loadWizard(ctx, wizardStateContent)
+		if err != nil || !ok {
+			return err
+		}
+		content := messageContent(ctx.Message())
+		if content.IsEmpty() {
+			return ctx.Send("Это сообщение нельзя разослать, отправьте текст, фото, документ, видео или голосовое")
+		}
+		draft.Content = content
+		err = b.saveWizard(ctx.Chat().ID, wizardStateConfirm, draft)
+		if err != nil {
+			return err
+		}
+
+		err = ctx.Send(fmt.Sprintf("Шаг 4/4. Предпросмотр рассылки по топику '%s' на список '%s':", draft.TopicName, draft.ListName))
+		if err != nil {
+			return err
+		}
+		_, err = b.sendContent(ctx.Recipient(), content, wizardConfirmMarkup(draft))
+		return err
+	default:
+		return ctx.Send("Воспользуйтесь кнопками выше или отмените рассылку командой /cancel")
+	}
+}
+
+func wizardConfirmMarkup(draft broadcastDraft) *telebot.ReplyMarkup {
+	reactions := "Кнопки реакций: нет"
+	if draft.Reactions {
+		reactions = "Кнопки реакций: 👍 / 👎 / Понятно"
+	}
+	tmpl := "Переменные в тексте: нет"
+	if draft.Content.Template {
+		tmpl = "Переменные в тексте: {{.RecipientName}} и др."
+	}
+	var replyMarkup = &telebot.ReplyMarkup{}
+	replyMarkup.Inline(
+		replyMarkup.Row(replyMarkup.Data(reactions, btnWizardReacts.Unique)),
+		replyMarkup.Row(replyMarkup.Data(tmpl, btnWizardTmpl.Unique)),
+		replyMarkup.Row(
+			replyMarkup.Data("Отправить", btnWizardConfirm.Unique),
+			replyMarkup.Data("Отмена", btnWizardCancel.Unique),
+		),
+	)
+	return replyMarkup
+}
+
+func (b *Bot) handleWizardReactsButton(ctx telebot.Context) error {
+	_ = ctx.Respond()
+	draft, ok, err := b.loadWizard(ctx, wizardStateConfirm)
+	if err != nil || !ok {
+		return err
+	}
+	draft.Reactions = !draft.Reactions
+	err = b.saveWizard(ctx.Chat().ID, wizardStateConfirm, draft)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.EditReplyMarkup(ctx.Message(), wizardConfirmMarkup(draft))
+	return err
+}
+
+// handleWizardTmplButton turns rendering of the text for every recipient on and off, see renderTemplate.
+func (b *Bot) handleWizardTmplButton(ctx telebot.Context) error {
+	_ = ctx.Respond()
+	draft, ok, err := b.loadWizard(ctx, wizardStateConfirm)
+	if err != nil || !ok {
+		return err
+	}
+	draft.Content.Template = !draft.Content.Template
+	err = b.saveWizard(ctx.Chat().ID, wizardStateConfirm, draft)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.EditReplyMarkup(ctx.Message(), wizardConfirmMarkup(draft))
+	return err
+}
+
+func (b *Bot) handleWizardConfirmButton(ctx telebot.Context) error {
+	_ = ctx.Respond()
+	draft, ok, err := b.loadWizard(ctx, wizardStateConfirm)
+	if err != nil || !ok {
+		return err
+	}
+	// delete first, so a second press doesn't send the broadcast twice
+	err = b.db.DeleteConversation(ctx.Chat().ID)
+	if err != nil {
+		return err
+	}
+
+	topic := models.Topic{TopicId: draft.TopicId, SenderTGId: senderOrgId(ctx), Topic: draft.TopicName}
+	if topic.TopicId == 0 {
+		topic, err = b.db.AddTopic(topic)
+		if err != nil {
+			log.Errorf("broadcast wizard: create topic: %v", err)
+			return err
+		}
+	}
+
+	broadcast, err := b.broadcast(senderOrgId(ctx), topic, draft.ListId, draft.Content, draft.Reactions)
+	var tmplErr *templateError
+	if errors.As(err, &tmplErr) {
+		return ctx.Send(formatTemplateError(tmplErr) + "\n\nИсправьте текст и начните заново командой /broadcast")
+	}
+	if err != nil {
+		log.Errorf("broadcast wizard: %v", err)
+		return err
+	}
+
+	return ctx.Send(fmt.Sprintf("Рассылка #%d поставлена в очередь, отчет о доставке придет по завершении", broadcast.BroadcastId))
+}
+
+// command: /cancel
+func (b *Bot) handleWizardCancel(ctx telebot.Context) error {
+	if ctx.Callback() != nil {
+		_ = ctx.Respond()
+	}
+	err := b.db.DeleteConversation(ctx.Chat().ID)
+	if err != nil {
+		return err
+	}
+	return ctx.Send("Создание рассылки отменено")
+}
+
+func (b *Bot) saveWizard(chatId int64, state string, draft broadcastDraft) error {
+	data, err := json.Marshal(draft)
+	if err != nil {
+		return err
+	}
+	return b.db.SaveConversation(models.Conversation{
+		ChatId:    chatId,
+		State:     state,
+		Data:      string(data),
+		UpdatedAt: time.Now(),
+	})
+}
+
+// loadWizard returns draft if chat's wizard is in the expected state and hasn't timed out.
+func (b *Bot) loadWizard(ctx telebot.Context, state string) (broadcastDraft, bool, error) {
+	conversation, err := b.db.GetConversation(ctx.Chat().ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return broadcastDraft{}, false, ctx.Send("Рассылка не найдена, начните заново командой /broadcast")
+	}
+	if err != nil {
+		return broadcastDraft{}, false, err
+	}
+	if time.Since(conversation.UpdatedAt) > b.cfg.WizardTimeout.Duration {
+		err = b.db.DeleteConversation(ctx.Chat().ID)
+		if err != nil {
+			return broadcastDraft{}, false, err
+		}
+		return broadcastDraft{}, false, ctx.Send("Время ожидания истекло, начните заново командой /broadcast")
+	}
+	if conversation.State != state {
+		return broadcastDraft{}, false, ctx.Send("Эта кнопка уже неактуальна")
+	}
+
+	draft := broadcastDraft{}
+	err = json.Unmarshal([]byte(conversation.Data), &draft)
+	if err != nil {
+		return broadcastDraft{}, false, fmt.Errorf("decode broadcast draft: %v", err)
+	}
+	return draft, true, nil
+}
+
+func (b *Bot) runWizardTimeouts() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+			err := b.expireWizards()
+			if err != nil {
+				log.Errorf("expire broadcast wizards: %v", err)
+			}
+		}
+	}
+}
+
+func (b *Bot) expireWizards() error {
+	conversations, err := b.db.GetConversationsUpdatedBefore(time.Now().Add(-b.cfg.WizardTimeout.Duration))
+	if err != nil {
+		return err
+	}
+	for _, conversation := range conversations {
+		err = b.db.DeleteConversation(conversation.ChatId)
+		if err != nil {
+			return err
+		}
+		_, err = b.client.Send(telebot.ChatID(conversation.ChatId), "Создание рассылки отменено из-за неактивности")
+		if err != nil {
+			log.Warnf("notify about expired broadcast wizard: %v", err)
+		}
+	}
+	return nil
+}
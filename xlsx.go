@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// excel doesn't open cells with longer text
+const maxXLSXCellLength = 32767
+
+// xlsxWriter writes a single sheet workbook row by row, cells are inline strings.
+// Only the sheet is kept open in the zip stream, so rows aren't buffered in memory.
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet io.Writer
+	rows  int
+	err   error
+}
+
+func newXLSXWriter(w io.Writer, sheetName string) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name, content string
+	}{
+		{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+			`</Types>`},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+			`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="` + xmlEscape(xlsxSheetName(sheetName)) + `" sheetId="1" r:id="rId1"/></sheets>` +
+			`</workbook>`},
+		{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+			`</Relationships>`},
+	}
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(fw, file.content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(sheet, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxWriter{zip: zw, sheet: sheet}, nil
+}
+
+func (w *xlsxWriter) Write(record []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.rows++
+	row := strconv.Itoa(w.rows)
+	w.write(`<row r="` + row + `">`)
+	for i, value := range record {
+		if utf8.RuneCountInString(value) > maxXLSXCellLength {
+			value = string([]rune(value)[:maxXLSXCellLength])
+		}
+		w.write(`<c r="` + xlsxColumn(i) + row + `" t="inlineStr"><is><t xml:space="preserve">` + xmlEscape(value) + `</t></is></c>`)
+	}
+	w.write(`</row>`)
+	return w.err
+}
+
+// Close finishes the workbook, it doesn't close the underlying writer.
+func (w *xlsxWriter) Close() error {
+	w.write(`</sheetData></worksheet>`)
+	if w.err != nil {
+		return w.err
+	}
+	return w.zip.Close()
+}
+
+func (w *xlsxWriter) write(s string) {
+	if w.err == nil {
+		_, w.err = io.WriteString(w.sheet, s)
+	}
+}
+
+// xlsxColumn returns column letters by zero based index: A, B, ..., Z, AA, ...
+func xlsxColumn(i int) string {
+	if i < 26 {
+		return string(rune('A' + i))
+	}
+	return xlsxColumn(i/26-1) + string(rune('A'+i%26))
+}
+
+// xlsxSheetName fits excel limits: at most 31 characters without []:*?/\.
+func xlsxSheetName(name string) string {
+	runes := make([]rune, 0, len(name))
+	for _, r := range name {
+		switch r {
+		case '[', ']', ':', '*', '?', '/', '\\':
+			r = '_'
+		}
+		runes = append(runes, r)
+	}
+	if len(runes) > 31 {
+		runes = runes[:31]
+	}
+	if len(runes) == 0 {
+		return "Sheet1"
+	}
+	return string(runes)
+}
+
+func xmlEscape(s string) string {
+	str := new(strings.Builder)
+	// EscapeText replaces characters that are invalid in XML, e.g. control ones, and never fails with strings.Builder
+	_ = xml.EscapeText(str, []byte(s))
+	return str.String()
+}